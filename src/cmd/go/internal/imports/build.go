@@ -213,7 +213,7 @@ func matchTag(name string, tags map[string]bool, prefer bool) bool {
 	case "darwin":
 		return tags["ios"]
 	case "unix":
-		return unixOS[cfg.BuildContext.GOOS]
+		return UnixOS[cfg.BuildContext.GOOS]
 	default:
 		return false
 	}
@@ -327,10 +327,10 @@ var KnownOS = map[string]bool{
 	"zos":       true,
 }
 
-// unixOS is the set of GOOS values matched by the "unix" build tag.
+// UnixOS is the set of GOOS values matched by the "unix" build tag.
 // This is not used for filename matching.
 // This is the same list as in go/build/syslist.go and cmd/dist/build.go.
-var unixOS = map[string]bool{
+var UnixOS = map[string]bool{
 	"aix":       true,
 	"android":   true,
 	"darwin":    true,
@@ -5,20 +5,34 @@
 package script
 
 import (
+	"archive/zip"
 	"cmd/go/internal/robustio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"internal/diff"
+	"internal/txtar"
+	"io"
 	"io/fs"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
+	"regexp/syntax"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 )
 
 // DefaultCmds returns a set of broadly useful script commands.
@@ -27,28 +41,54 @@ import (
 // commands.
 func DefaultCmds() map[string]Cmd {
 	return map[string]Cmd{
-		"cat":     Cat(),
-		"cd":      Cd(),
-		"chmod":   Chmod(),
-		"cmp":     Cmp(),
-		"cmpenv":  Cmpenv(),
-		"cp":      Cp(),
-		"echo":    Echo(),
-		"env":     Env(),
-		"exec":    Exec(func(cmd *exec.Cmd) error { return cmd.Process.Signal(os.Interrupt) }, 100*time.Millisecond), // arbitrary grace period
-		"exists":  Exists(),
-		"grep":    Grep(),
-		"help":    Help(),
-		"mkdir":   Mkdir(),
-		"mv":      Mv(),
-		"rm":      Rm(),
-		"replace": Replace(),
-		"sleep":   Sleep(),
-		"stderr":  Stderr(),
-		"stdout":  Stdout(),
-		"stop":    Stop(),
-		"symlink": Symlink(),
-		"wait":    Wait(),
+		"base64":     Base64(),
+		"cat":        Cat(),
+		"cd":         Cd(),
+		"chmod":      Chmod(),
+		"cmp":        Cmp(),
+		"cmpenv":     Cmpenv(),
+		"cp":         Cp(),
+		"defer":      Defer(),
+		"diff":       Diff(),
+		"echo":       Echo(),
+		"env":        Env(),
+		"exec":       Exec(func(cmd *exec.Cmd) error { return cmd.Process.Signal(os.Interrupt) }, 100*time.Millisecond), // arbitrary grace period
+		"exists":     Exists(),
+		"expect":     Expect(),
+		"find":       Find(),
+		"gen":        Gen(),
+		"grep":       Grep(),
+		"hash":       Hash(),
+		"head":       Head(),
+		"help":       Help(),
+		"kill":       Kill(),
+		"mkdir":      Mkdir(),
+		"mktemp":     Mktemp(),
+		"mv":         Mv(),
+		"pwd":        Pwd(),
+		"readlink":   Readlink(),
+		"rm":         Rm(),
+		"replace":    Replace(),
+		"retry":      Retry(),
+		"setenvfile": Setenvfile(),
+		"sleep":      Sleep(),
+		"sort":       Sort(),
+		"stat":       Stat(),
+		"stderr":     Stderr(),
+		"stdin":      Stdin(),
+		"stdout":     Stdout(),
+		"stop":       Stop(),
+		"symlink":    Symlink(),
+		"tail":       Tail(),
+		"tar":        Tar(),
+		"touch":      Touch(),
+		"trim":       Trim(),
+		"untar":      Untar(),
+		"unzip":      Unzip(),
+		"wait":       Wait(),
+		"waitfor":    WaitFor(),
+		"wc":         Wc(),
+		"write":      Write(),
 	}
 }
 
@@ -73,6 +113,38 @@ func (c *funcCmd) Run(s *State, args ...string) (WaitFunc, error) {
 
 func (c *funcCmd) Usage() *CmdUsage { return &c.usage }
 
+// ParseFlags parses the flags at the start of args, calling set for each one,
+// and returns the remaining arguments.
+//
+// Flag parsing stops at the first argument that does not begin with "-" (or is
+// just "-"), or for which set reports ok == false; that argument and the ones
+// after it are returned. It also stops after an argument "--", which is not
+// returned, so that a script can pass an operand that begins with "-" (as in
+// 'rm -- -file'). If set returns a non-nil error, ParseFlags returns it.
+//
+// The built-in commands use ParseFlags, and commands defined outside this
+// package may use it to treat their flags consistently with them.
+func ParseFlags(args []string, set func(flag string) (ok bool, err error)) ([]string, error) {
+	for len(args) > 0 {
+		arg := args[0]
+		if arg == "--" {
+			return args[1:], nil
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			break
+		}
+		ok, err := set(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		args = args[1:]
+	}
+	return args, nil
+}
+
 // firstNonFlag returns a slice containing the index of the first argument in
 // rawArgs that is not a flag, or nil if all arguments are flags.
 func firstNonFlag(rawArgs ...string) []int {
@@ -87,22 +159,154 @@ func firstNonFlag(rawArgs ...string) []int {
 	return nil
 }
 
+// Base64 encodes a file in base64, or decodes a base64-encoded file.
+func Base64() Cmd {
+	return Command(
+		CmdUsage{
+			Summary: "encode or decode base64 data",
+			Args:    "[-d] infile outfile",
+			Detail: []string{
+				"Writes the standard base64 encoding of infile to outfile, in lines of at most 76 characters.",
+				"With -d, infile is instead decoded from base64 and the resulting data written to outfile. Line breaks in infile are ignored, so a file written by base64 (or embedded in a txtar archive) can be decoded.",
+				"Infile and outfile must be different files. If the conversion fails, outfile is removed.",
+			},
+		},
+		func(s *State, args ...string) (WaitFunc, error) {
+			decode := false
+			args, err := ParseFlags(args, func(flag string) (bool, error) {
+				if flag != "-d" {
+					return false, nil
+				}
+				decode = true
+				return true, nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			if len(args) != 2 {
+				return nil, ErrUsage
+			}
+
+			src, err := s.ResolvePath(args[0])
+			if err != nil {
+				return nil, err
+			}
+			dst, err := s.ResolvePath(args[1])
+			if err != nil {
+				return nil, err
+			}
+			in, err := os.Open(src)
+			if err != nil {
+				return nil, err
+			}
+			defer in.Close()
+			if inInfo, err := in.Stat(); err != nil {
+				return nil, err
+			} else if outInfo, err := os.Stat(dst); err == nil && os.SameFile(inInfo, outInfo) {
+				// Creating outfile would truncate infile before it was read.
+				return nil, fmt.Errorf("%s and %s are the same file", args[0], args[1])
+			}
+			out, err := os.Create(dst)
+			if err != nil {
+				return nil, err
+			}
+
+			if decode {
+				_, err = io.Copy(out, base64.NewDecoder(base64.StdEncoding, in))
+				if err != nil {
+					err = fmt.Errorf("%s: %w", args[0], err)
+				}
+			} else {
+				lw := &lineWrapper{w: out, width: 76}
+				enc := base64.NewEncoder(base64.StdEncoding, lw)
+				_, err = io.Copy(enc, in)
+				if closeErr := enc.Close(); err == nil {
+					err = closeErr
+				}
+				if err == nil && lw.col > 0 {
+					_, err = io.WriteString(out, "\n")
+				}
+			}
+			if closeErr := out.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				// Don't leave partial output that a later command could mistake
+				// for the result.
+				os.Remove(dst)
+				return nil, err
+			}
+			return nil, nil
+		})
+}
+
+// A lineWrapper is an io.Writer that inserts a newline into the stream of
+// bytes written to w after every width bytes.
+type lineWrapper struct {
+	w     io.Writer
+	width int
+	col   int // bytes written since the last newline
+}
+
+func (lw *lineWrapper) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if lw.col == lw.width {
+			if _, err := io.WriteString(lw.w, "\n"); err != nil {
+				return n, err
+			}
+			lw.col = 0
+		}
+		chunk := p
+		if len(chunk) > lw.width-lw.col {
+			chunk = chunk[:lw.width-lw.col]
+		}
+		m, err := lw.w.Write(chunk)
+		n += m
+		lw.col += m
+		if err != nil {
+			return n, err
+		}
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
 // Cat writes the concatenated contents of the named file(s) to the script's
 // stdout buffer.
 func Cat() Cmd {
 	return Command(
 		CmdUsage{
 			Summary: "concatenate files and print to the script's stdout buffer",
-			Args:    "files...",
+			Args:    "[-f] files...",
+			Detail: []string{
+				"With -f, files that do not exist are ignored.",
+			},
+			ReadOnly: true,
 		},
 		func(s *State, args ...string) (WaitFunc, error) {
+			var ignoreMissing bool
+			args, err := ParseFlags(args, func(flag string) (bool, error) {
+				if flag != "-f" {
+					return false, nil
+				}
+				ignoreMissing = true
+				return true, nil
+			})
+			if err != nil {
+				return nil, err
+			}
 			if len(args) == 0 {
 				return nil, ErrUsage
 			}
 
 			paths := make([]string, 0, len(args))
 			for _, arg := range args {
-				paths = append(paths, s.Path(arg))
+				p, err := s.ResolvePath(arg)
+				if err != nil {
+					return nil, err
+				}
+				paths = append(paths, p)
 			}
 
 			var buf strings.Builder
@@ -111,6 +315,9 @@ func Cat() Cmd {
 				for _, p := range paths {
 					b, err := os.ReadFile(p)
 					buf.Write(b)
+					if ignoreMissing && errors.Is(err, fs.ErrNotExist) {
+						continue
+					}
 					if err != nil {
 						errc <- err
 						return
@@ -132,13 +339,26 @@ func Cd() Cmd {
 	return Command(
 		CmdUsage{
 			Summary: "change the working directory",
-			Args:    "dir",
+			Args:    "[dir | -]",
+			Detail: []string{
+				"With no argument, changes to the script's initial working directory. With -, changes back to the directory that was current before the last successful change.",
+			},
+			ReadOnly: true,
 		},
 		func(s *State, args ...string) (WaitFunc, error) {
-			if len(args) != 1 {
+			switch {
+			case len(args) == 0:
+				return nil, s.Chdir(s.workdir)
+			case len(args) == 1 && args[0] == "-":
+				if s.oldpwd == "" {
+					return nil, errors.New("no previous directory")
+				}
+				return nil, s.Chdir(s.oldpwd)
+			case len(args) == 1:
+				return nil, s.Chdir(args[0])
+			default:
 				return nil, ErrUsage
 			}
-			return nil, s.Chdir(args[0])
 		})
 }
 
@@ -147,45 +367,181 @@ func Chmod() Cmd {
 	return Command(
 		CmdUsage{
 			Summary: "change file mode bits",
-			Args:    "perm paths...",
+			Args:    "[-R] perm paths...",
 			Detail: []string{
-				"Changes the permissions of the named files or directories to be equal to perm.",
-				"Only numerical permissions are supported.",
+				"Changes the permissions of the named files or directories according to perm.",
+				"The perm may be numeric (octal), or symbolic: a comma-separated list of clauses of the form [ugoa...][+-=][rwx...], as for Unix chmod. If no u, g, o, or a is given, a is assumed.",
+				"With -R, the permissions of the files and directories within each named directory are also changed. Symlinks within the tree are skipped.",
+				"On Windows, only the write permission of the owner has any effect; other bits are accepted but ignored.",
 			},
 		},
 		func(s *State, args ...string) (WaitFunc, error) {
+			recursive := false
+			args, err := ParseFlags(args, func(flag string) (bool, error) {
+				if flag != "-R" {
+					return false, nil
+				}
+				recursive = true
+				return true, nil
+			})
+			if err != nil {
+				return nil, err
+			}
 			if len(args) < 2 {
 				return nil, ErrUsage
 			}
 
-			perm, err := strconv.ParseUint(args[0], 0, 32)
-			if err != nil || perm&uint64(fs.ModePerm) != perm {
-				return nil, fmt.Errorf("invalid mode: %s", args[0])
+			mode, err := parseMode(args[0])
+			if err != nil {
+				return nil, err
 			}
 
 			for _, arg := range args[1:] {
-				err := os.Chmod(s.Path(arg), fs.FileMode(perm))
+				path, err := s.ResolvePath(arg)
 				if err != nil {
 					return nil, err
 				}
+				paths := []string{path}
+				if recursive {
+					paths, err = walkForChmod(path)
+					if err != nil {
+						return nil, err
+					}
+				}
+				// Apply the changes from the leaves up, so that removing permissions
+				// from a directory does not prevent changing its contents.
+				for i := len(paths) - 1; i >= 0; i-- {
+					info, err := os.Stat(paths[i])
+					if err != nil {
+						return nil, err
+					}
+					if err := os.Chmod(paths[i], mode(info.Mode().Perm())); err != nil {
+						return nil, err
+					}
+				}
 			}
 			return nil, nil
 		})
 }
 
+// walkForChmod returns the paths of root and every file and directory within
+// it, skipping symlinks, with each directory preceding its contents.
+func walkForChmod(root string) ([]string, error) {
+	var paths []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != root && d.Type()&fs.ModeSymlink != 0 {
+			return nil
+		}
+		paths = append(paths, path)
+		return nil
+	})
+	return paths, err
+}
+
+// parseMode parses a numeric or symbolic mode as accepted by the chmod
+// command, returning a function that computes the new permission bits of a
+// file from its existing ones.
+func parseMode(perm string) (func(fs.FileMode) fs.FileMode, error) {
+	if n, err := strconv.ParseUint(perm, 0, 32); err == nil {
+		if n&uint64(fs.ModePerm) != n {
+			return nil, fmt.Errorf("invalid mode: %s", perm)
+		}
+		return func(fs.FileMode) fs.FileMode { return fs.FileMode(n) }, nil
+	}
+
+	type change struct {
+		op   byte
+		who  fs.FileMode // mask of the bits affected
+		bits fs.FileMode
+	}
+	var changes []change
+	for _, clause := range strings.Split(perm, ",") {
+		var who fs.FileMode
+		i := 0
+	who:
+		for ; i < len(clause); i++ {
+			switch clause[i] {
+			case 'u':
+				who |= 0700
+			case 'g':
+				who |= 0070
+			case 'o':
+				who |= 0007
+			case 'a':
+				who |= 0777
+			default:
+				break who
+			}
+		}
+		if who == 0 {
+			who = 0777
+		}
+		if i == len(clause) {
+			return nil, fmt.Errorf("invalid mode: %s", perm)
+		}
+		for i < len(clause) {
+			op := clause[i]
+			if op != '+' && op != '-' && op != '=' {
+				return nil, fmt.Errorf("invalid mode: %s", perm)
+			}
+			i++
+			var bits fs.FileMode
+		bits:
+			for ; i < len(clause); i++ {
+				switch clause[i] {
+				case 'r':
+					bits |= 0444
+				case 'w':
+					bits |= 0222
+				case 'x':
+					bits |= 0111
+				default:
+					break bits
+				}
+			}
+			changes = append(changes, change{op: op, who: who, bits: bits & who})
+		}
+	}
+
+	return func(m fs.FileMode) fs.FileMode {
+		for _, c := range changes {
+			switch c.op {
+			case '+':
+				m |= c.bits
+			case '-':
+				m &^= c.bits
+			case '=':
+				m = m&^c.who | c.bits
+			}
+		}
+		return m
+	}, nil
+}
+
 // Cmp compares the contents of two files, or the contents of either the
 // "stdout" or "stderr" buffer and a file, returning a non-nil error if the
 // contents differ.
 func Cmp() Cmd {
 	return Command(
 		CmdUsage{
-			Args:    "[-q] file1 file2",
+			Args:    "[-q] [-strip-trailing-cr] [-ignore-lines=regexp]... [-sort-lines] [-trim] [-regexp] [-bin] [-max-diff-lines=N] file1 file2",
 			Summary: "compare files for differences",
 			Detail: []string{
 				"By convention, file1 is the actual data and file2 is the expected data.",
 				"The command succeeds if the file contents are identical.",
 				"File1 can be 'stdout' or 'stderr' to compare the stdout or stderr buffer from the most recent command.",
+				"With -strip-trailing-cr, CRLF line endings in either file are treated as LF. If the engine's UpdateGolden mode rewrites file2, the new contents use CRLF line endings if file2 did.",
+				ignoreLinesDetail,
+				sortLinesDetail,
+				trimDetail,
+				"With -regexp, each line of file2 is instead a regular expression that must match the entire corresponding line of file1, and both files must have the same number of lines. UpdateGolden does not rewrite such a file2.",
+				"With -bin, a mismatch is shown as the offset of the first differing byte and a side-by-side hex dump of the files around it, instead of a line-based diff.",
+				maxDiffLinesDetail,
 			},
+			ReadOnly: true,
 		},
 		func(s *State, args ...string) (WaitFunc, error) {
 			return nil, doCompare(s, false, args...)
@@ -197,24 +553,90 @@ func Cmp() Cmd {
 func Cmpenv() Cmd {
 	return Command(
 		CmdUsage{
-			Args:    "[-q] file1 file2",
+			Args:    "[-q] [-i] [-strip-trailing-cr] [-ignore-lines=regexp]... [-sort-lines] [-trim] [-count=N] [-max-diff-lines=N] file1 file2",
 			Summary: "compare files for differences, with environment expansion",
 			Detail: []string{
 				"By convention, file1 is the actual data and file2 is the expected data.",
 				"The command succeeds if the file contents are identical after substituting variables from the script environment.",
 				"File1 can be 'stdout' or 'stderr' to compare the script's stdout or stderr buffer.",
+				"The -i flag makes the comparison case-insensitive.",
+				"With -strip-trailing-cr, CRLF line endings in either file are treated as LF.",
+				ignoreLinesDetail,
+				sortLinesDetail,
+				trimDetail,
+				"With -count=N, the command instead succeeds if the contents of file2, without any trailing newline, occur exactly N times (without overlap) in file1.",
+				maxDiffLinesDetail,
 			},
+			ReadOnly: true,
 		},
 		func(s *State, args ...string) (WaitFunc, error) {
 			return nil, doCompare(s, true, args...)
 		})
 }
 
+const ignoreLinesDetail = "With -ignore-lines=regexp, which may be repeated, lines of either file that match any of the regular expressions are dropped before the comparison, so line numbers and counts refer to the remaining lines. If UpdateGolden rewrites file2, it writes the unfiltered contents of file1."
+
+const maxDiffLinesDetail = "With -max-diff-lines=N, a diff shown for a mismatch is truncated after N lines, followed by a count of the omitted differences; N=0 shows the whole diff. The default is the engine's MaxDiffLines."
+
+const sortLinesDetail = "With -sort-lines, the lines of each file are sorted, after any -ignore-lines filtering, so that the order of lines does not matter. If UpdateGolden rewrites file2, it writes the unsorted contents of file1."
+
+const trimDetail = "With -trim, leading and trailing white space (including newlines) is removed from the contents of each file as a whole, after any -ignore-lines filtering and -sort-lines sorting, before the comparison. If UpdateGolden rewrites file2, it writes the untrimmed contents of file1."
+
 func doCompare(s *State, env bool, args ...string) error {
 	quiet := false
-	if len(args) > 0 && args[0] == "-q" {
-		quiet = true
-		args = args[1:]
+	foldCase := false
+	stripCR := false
+	regexpLines := false
+	binary := false
+	sortLines := false
+	trim := false
+	count := -1
+	maxDiffLines := -1 // use the engine's MaxDiffLines
+	var ignore []*regexp.Regexp
+	args, err := ParseFlags(args, func(flag string) (bool, error) {
+		switch {
+		case flag == "-q":
+			quiet = true
+		case !env && flag == "-regexp":
+			regexpLines = true
+		case !env && flag == "-bin":
+			binary = true
+		case flag == "-strip-trailing-cr":
+			stripCR = true
+		case flag == "-sort-lines":
+			sortLines = true
+		case flag == "-trim":
+			trim = true
+		case strings.HasPrefix(flag, "-ignore-lines="):
+			re, err := regexp.Compile(flag[len("-ignore-lines="):])
+			if err != nil {
+				return false, fmt.Errorf("bad -ignore-lines=: %v", err)
+			}
+			ignore = append(ignore, re)
+		case env && flag == "-i":
+			foldCase = true
+		case strings.HasPrefix(flag, "-max-diff-lines="):
+			n, err := parseMaxDiffLines(flag)
+			if err != nil {
+				return false, err
+			}
+			maxDiffLines = n
+		case env && strings.HasPrefix(flag, "-count="):
+			n, err := strconv.Atoi(flag[len("-count="):])
+			if err != nil {
+				return false, fmt.Errorf("bad -count=: %v", err)
+			}
+			if n < 0 {
+				return false, fmt.Errorf("bad -count=: must be non-negative")
+			}
+			count = n
+		default:
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		return err
 	}
 	if len(args) != 2 {
 		return ErrUsage
@@ -228,14 +650,14 @@ func doCompare(s *State, env bool, args ...string) error {
 	case "stderr":
 		text1 = s.Stderr()
 	default:
-		data, err := os.ReadFile(s.Path(name1))
+		data, err := s.ReadFile(name1)
 		if err != nil {
 			return err
 		}
 		text1 = string(data)
 	}
 
-	data, err := os.ReadFile(s.Path(name2))
+	data, err := s.ReadFile(name2)
 	if err != nil {
 		return err
 	}
@@ -245,33 +667,287 @@ func doCompare(s *State, env bool, args ...string) error {
 		text1 = s.ExpandEnv(text1, false)
 		text2 = s.ExpandEnv(text2, false)
 	}
+	crlf := false // file2 had CRLF line endings that were stripped
+	if stripCR {
+		crlf = strings.Contains(text2, "\r\n")
+		text1 = strings.ReplaceAll(text1, "\r\n", "\n")
+		text2 = strings.ReplaceAll(text2, "\r\n", "\n")
+	}
+	actual := text1 // the contents of file1 before dropping ignored lines, sorting, or trimming
+	if len(ignore) > 0 {
+		text1 = dropLines(text1, ignore)
+		text2 = dropLines(text2, ignore)
+	}
+	if sortLines {
+		text1 = sortTextLines(text1)
+		text2 = sortTextLines(text2)
+	}
+	if trim {
+		text1 = strings.TrimSpace(text1)
+		text2 = strings.TrimSpace(text2)
+	}
+
+	if regexpLines {
+		return compareRegexpLines(name1, text1, name2, text2)
+	}
 
+	if count >= 0 {
+		// Archive files always end in a newline; don't require one in file1.
+		text2 = strings.TrimSuffix(text2, "\n")
+		if foldCase {
+			text1, text2 = strings.ToLower(text1), strings.ToLower(text2)
+		}
+		if text2 == "" {
+			return fmt.Errorf("%s is empty", name2)
+		}
+		if n := strings.Count(text1, text2); n != count {
+			return fmt.Errorf("found %d occurrences of %s in %s", n, name2, name1)
+		}
+		return nil
+	}
+
+	if foldCase && strings.EqualFold(text1, text2) {
+		return nil
+	}
 	if text1 != text2 {
-		if !quiet {
+		if binary && !quiet {
+			s.Logf("%s", hexDiff(name1, text1, name2, text2))
+		} else if !quiet {
 			diffText := diff.Diff(name1, []byte(text1), name2, []byte(text2))
-			s.Logf("%s\n", diffText)
+			s.Logf("%s\n", truncateDiff(s, diffText, maxDiffLines))
+		}
+		if env {
+			return fmt.Errorf("%s and %s differ", name1, name2)
+		}
+		if crlf {
+			// Preserve the line endings of the expected file if it is updated.
+			actual = strings.ReplaceAll(actual, "\n", "\r\n")
+		}
+		return &mismatchError{
+			name1: name1,
+			name:  name2,
+			path:  s.Path(name2),
+			data:  []byte(actual),
+		}
+	}
+	return nil
+}
+
+// parseMaxDiffLines parses a -max-diff-lines=N flag.
+func parseMaxDiffLines(flag string) (int, error) {
+	n, err := strconv.Atoi(flag[len("-max-diff-lines="):])
+	if err != nil {
+		return 0, fmt.Errorf("bad -max-diff-lines=: %v", err)
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("bad -max-diff-lines=: must be non-negative")
+	}
+	return n, nil
+}
+
+// truncateDiff returns the unified diff d, truncated to max lines.
+// If max is negative, the limit is the MaxDiffLines of the engine running s,
+// if any; if the limit is 0, d is not truncated.
+//
+// A truncated diff ends with a line reporting the number of added and
+// removed lines that were omitted.
+func truncateDiff(s *State, d []byte, max int) string {
+	if max < 0 {
+		max = 0
+		if s.engine != nil {
+			max = s.engine.MaxDiffLines
+		}
+	}
+	text := string(d)
+	if max == 0 {
+		return text
+	}
+
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) <= max {
+		return text
+	}
+
+	omitted := 0
+	for _, line := range lines[max:] {
+		if (strings.HasPrefix(line, "+") && !strings.HasPrefix(line, "+++ ")) || (strings.HasPrefix(line, "-") && !strings.HasPrefix(line, "--- ")) {
+			omitted++
+		}
+	}
+	return fmt.Sprintf("%s... (%d more differences)\n", strings.Join(lines[:max], ""), omitted)
+}
+
+// dropLines returns text without the lines matched by any of the regular
+// expressions in ignore.
+func dropLines(text string, ignore []*regexp.Regexp) string {
+	var b strings.Builder
+lines:
+	for _, line := range strings.SplitAfter(text, "\n") {
+		for _, re := range ignore {
+			if line != "" && re.MatchString(strings.TrimSuffix(line, "\n")) {
+				continue lines
+			}
+		}
+		b.WriteString(line)
+	}
+	return b.String()
+}
+
+// sortTextLines returns text with its lines sorted.
+// A final newline, if any, remains at the end.
+func sortTextLines(text string) string {
+	body, nl := strings.CutSuffix(text, "\n")
+	if body == "" {
+		return text
+	}
+	lines := strings.Split(body, "\n")
+	sort.Strings(lines)
+	body = strings.Join(lines, "\n")
+	if nl {
+		body += "\n"
+	}
+	return body
+}
+
+// hexDiff returns a description of the first difference between the unequal
+// contents of two files: its offset, followed by a side-by-side hex dump of the
+// rows of 16 bytes surrounding it.
+func hexDiff(name1, data1, name2, data2 string) string {
+	const (
+		width   = 16 // bytes per row
+		context = 2  // rows before and after the row containing the difference
+	)
+	off := 0
+	for off < len(data1) && off < len(data2) && data1[off] == data2[off] {
+		off++
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s and %s differ at offset %d (%#x); lengths %d and %d\n", name1, name2, off, off, len(data1), len(data2))
+	row := func(data string, start int) string {
+		var r strings.Builder
+		for i := start; i < start+width; i++ {
+			if i > start {
+				r.WriteByte(' ')
+			}
+			if i < len(data) {
+				fmt.Fprintf(&r, "%02x", data[i])
+			} else {
+				r.WriteString("  ")
+			}
+		}
+		return r.String()
+	}
+	first := (off/width - context) * width
+	if first < 0 {
+		first = 0
+	}
+	last := (off/width + context) * width
+	fmt.Fprintf(&b, "%-8s  %-*s  %s\n", "offset", 3*width-1, name1, name2)
+	for start := first; start <= last && (start < len(data1) || start < len(data2)); start += width {
+		mark := " "
+		if start <= off && off < start+width {
+			mark = ">"
+		}
+		line := fmt.Sprintf("%08x%s %s  %s", start, mark, row(data1, start), row(data2, start))
+		b.WriteString(strings.TrimRight(line, " "))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// compareRegexpLines reports whether each line of text1 is matched in its
+// entirety by the regular expression on the corresponding line of text2.
+func compareRegexpLines(name1, text1, name2, text2 string) error {
+	lines1 := strings.Split(strings.TrimSuffix(text1, "\n"), "\n")
+	lines2 := strings.Split(strings.TrimSuffix(text2, "\n"), "\n")
+	if text1 == "" {
+		lines1 = nil
+	}
+	if text2 == "" {
+		lines2 = nil
+	}
+	if len(lines1) != len(lines2) {
+		return fmt.Errorf("%s has %d lines, but %s has %d", name1, len(lines1), name2, len(lines2))
+	}
+	for i, pat := range lines2 {
+		re, err := regexp.Compile(`^(?:` + pat + `)$`)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", name2, i+1, err)
+		}
+		if !re.MatchString(lines1[i]) {
+			return fmt.Errorf("%s:%d: %q does not match %s:%d: %#q", name1, i+1, lines1[i], name2, i+1, pat)
 		}
-		return fmt.Errorf("%s and %s differ", name1, name2)
 	}
 	return nil
 }
 
+// A mismatchError reports that the files compared by 'cmp' differ.
+// It records the expected contents for use by Engine.UpdateGolden.
+type mismatchError struct {
+	name1, name string // the names of the files as passed to cmp
+	path        string // the absolute path of the second file
+	data        []byte // the contents of the first file
+}
+
+func (e *mismatchError) Error() string {
+	return fmt.Sprintf("%s and %s differ", e.name1, e.name)
+}
+
+// NewMismatchError returns an error reporting that the file name1 differs
+// from name2, which holds the expected data, for use by comparison commands
+// other than 'cmp'. As for 'cmp', if Engine.UpdateGolden is set, a command
+// that returns such an error succeeds instead if name2 can be updated to
+// actual, the contents of name1.
+func NewMismatchError(s *State, name1, name2 string, actual []byte) error {
+	return &mismatchError{name1: name1, name: name2, path: s.Path(name2), data: actual}
+}
+
 // Cp copies one or more files to a new location.
 func Cp() Cmd {
 	return Command(
 		CmdUsage{
 			Summary: "copy files to a target file or directory",
-			Args:    "src... dst",
+			Args:    "[-r [-L]] src... dst",
 			Detail: []string{
 				"src can include 'stdout' or 'stderr' to copy from the script's stdout or stderr buffer.",
+				"With -r, directories are copied recursively, preserving file modes. Symlinks are copied as symlinks, unless -L is also given, in which case the files they refer to are copied instead.",
+				"If dst is an existing directory, each src is copied into it. A directory cannot be copied into itself.",
 			},
 		},
 		func(s *State, args ...string) (WaitFunc, error) {
+			var recursive, followLinks bool
+			args, err := ParseFlags(args, func(flag string) (bool, error) {
+				switch flag {
+				case "-r":
+					recursive = true
+				case "-L":
+					followLinks = true
+				default:
+					return false, nil
+				}
+				return true, nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			if followLinks && !recursive {
+				return nil, ErrUsage
+			}
 			if len(args) < 2 {
 				return nil, ErrUsage
 			}
 
-			dst := s.Path(args[len(args)-1])
+			if followLinks && s.engine != nil && s.engine.Sandbox {
+				return nil, errors.New("cannot follow symlinks in the sandbox")
+			}
+			dst, err := s.ResolvePath(args[len(args)-1])
+			if err != nil {
+				return nil, err
+			}
 			info, err := os.Stat(dst)
 			dstDir := err == nil && info.IsDir()
 			if len(args) > 2 && !dstDir {
@@ -294,7 +970,25 @@ func Cp() Cmd {
 					data = []byte(s.Stderr())
 					mode = 0666
 				default:
-					src = s.Path(arg)
+					src, err = s.ResolvePath(arg)
+					if err != nil {
+						return nil, err
+					}
+					if recursive {
+						targ := dst
+						if dstDir {
+							targ = filepath.Join(dst, filepath.Base(src))
+						}
+						if within(targ, src) {
+							// The copy would be part of the tree being copied,
+							// so copying it would never end.
+							return nil, fmt.Errorf("cannot copy %s into itself", src)
+						}
+						if err := copyEntry(targ, src, followLinks, s.checkWrite); err != nil {
+							return nil, err
+						}
+						continue
+					}
 					info, err := os.Stat(src)
 					if err != nil {
 						return nil, err
@@ -308,6 +1002,9 @@ func Cp() Cmd {
 				targ := dst
 				if dstDir {
 					targ = filepath.Join(dst, filepath.Base(src))
+					if err := s.checkSandbox(targ, true); err != nil {
+						return nil, err
+					}
 				}
 				err := os.WriteFile(targ, data, mode)
 				if err != nil {
@@ -319,29 +1016,177 @@ func Cp() Cmd {
 		})
 }
 
-// Echo writes its arguments to stdout, followed by a newline.
-func Echo() Cmd {
+// Defer registers a command to be run when the script's State is closed.
+func Defer() Cmd {
 	return Command(
 		CmdUsage{
-			Summary: "display a line of text",
-			Args:    "string...",
+			Summary: "run a command when the script ends",
+			Args:    "cmd [args...]",
+			Detail: []string{
+				"Arranges for cmd to be run with the given arguments (as expanded when the defer command itself runs) when the State is closed, even if the script fails.",
+				"Deferred commands run in the reverse of the order in which they were deferred, before any remaining background commands are stopped. Their output and errors are written to the log, but do not cause the script to fail.",
+				"Deferred commands are run like the commands of the script itself: the Engine's Aliases, DryRun, JSONLog, and BeforeCommand and AfterCommand hooks apply to them.",
+			},
+			ReadOnly: true,
 		},
 		func(s *State, args ...string) (WaitFunc, error) {
-			var buf strings.Builder
-			for i, arg := range args {
-				if i > 0 {
-					buf.WriteString(" ")
-				}
-				buf.WriteString(arg)
+			if s.engine == nil {
+				return nil, errors.New("no engine configured")
 			}
-			buf.WriteString("\n")
-			out := buf.String()
-
-			// Stuff the result into a callback to satisfy the OutputCommandFunc
-			// interface, even though it isn't really asynchronous even if run in the
-			// background.
-			//
-			// Nobody should be running 'echo' as a background command, but it's not worth
+			if len(args) == 0 {
+				return nil, ErrUsage
+			}
+			e := s.engine
+			d := &command{name: args[0]}
+			if s.running != nil {
+				d.file, d.line = s.running.file, s.running.line
+			}
+			for _, arg := range args[1:] {
+				d.rawArgs = append(d.rawArgs, []argFragment{{s: arg, quoted: true}})
+			}
+			if err := e.expandAlias(d); err != nil {
+				return nil, err
+			}
+			if e.Cmds[d.name] == nil {
+				return nil, fmt.Errorf("unknown command %q", d.name)
+			}
+			line := args[0]
+			if len(args) > 1 {
+				line += " " + quoteArgs(args[1:])
+			}
+			s.deferred = append(s.deferred, func(s *State) {
+				defer func(prev *Engine) { s.engine = prev }(s.engine)
+				s.engine = e
+
+				s.Logf("[deferred] %s\n", line)
+				if err := e.runSubcommand(s, d); err != nil {
+					s.Logf("[%v]\n", err)
+				}
+			})
+			return nil, nil
+		})
+}
+
+// Diff writes a unified diff of two files to stdout.
+func Diff() Cmd {
+	return Command(
+		CmdUsage{
+			Summary: "show the differences between two files",
+			Args:    "[-max-diff-lines=N] file1 file2",
+			Detail: []string{
+				"Either file may be 'stdout' or 'stderr' to use the script's stdout or stderr buffer.",
+				"The diff is written to stdout, and the command fails if the files differ, with the diff in its error.",
+				"With -max-diff-lines=N, the diff is truncated after N lines, followed by a count of the omitted differences. Otherwise, the whole diff is written to stdout: unlike cmp, diff applies the engine's MaxDiffLines only to the diff in its error.",
+			},
+			ReadOnly: true,
+		},
+		func(s *State, args ...string) (WaitFunc, error) {
+			maxDiffLines := 0
+			args, err := ParseFlags(args, func(flag string) (bool, error) {
+				if !strings.HasPrefix(flag, "-max-diff-lines=") {
+					return false, nil
+				}
+				n, err := parseMaxDiffLines(flag)
+				if err != nil {
+					return false, err
+				}
+				maxDiffLines = n
+				return true, nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			if len(args) != 2 {
+				return nil, ErrUsage
+			}
+			var data [2][]byte
+			for i, name := range args {
+				switch name {
+				case "stdout":
+					data[i] = []byte(s.Stdout())
+				case "stderr":
+					data[i] = []byte(s.Stderr())
+				default:
+					var err error
+					data[i], err = s.ReadFile(name)
+					if err != nil {
+						return nil, err
+					}
+				}
+			}
+
+			out := diff.Diff(args[0], data[0], args[1], data[1])
+			return func(s *State) (stdout, stderr string, err error) {
+				if out != nil {
+					limit := maxDiffLines
+					if limit == 0 {
+						limit = -1
+					}
+					err = fmt.Errorf("%s and %s differ:\n%s", args[0], args[1], strings.TrimSuffix(truncateDiff(s, out, limit), "\n"))
+				}
+				return truncateDiff(s, out, maxDiffLines), "", err
+			}, nil
+		})
+}
+
+// Echo writes its arguments to stdout, followed by a newline.
+func Echo() Cmd {
+	return Command(
+		CmdUsage{
+			Summary: "display a line of text",
+			Args:    "[-n] [-f] string...",
+			Detail: []string{
+				"With -n, the trailing newline is omitted.",
+				"With -f, the first string is a format in the style of fmt.Printf, and the remaining strings are its operands (to be formatted with verbs such as %s and %q), instead of being joined by spaces.",
+				"Formatting requires -f even with -n, so that text containing % is written unchanged unless -f is given: 'echo -n -f %s=%s NAME VALUE' writes NAME=VALUE, but 'echo -n %s=%s NAME VALUE' writes '%s=%s NAME VALUE'.",
+			},
+			ReadOnly: true,
+		},
+		func(s *State, args ...string) (WaitFunc, error) {
+			newline, format := true, false
+			args, err := ParseFlags(args, func(flag string) (bool, error) {
+				switch flag {
+				case "-n":
+					newline = false
+				case "-f":
+					format = true
+				default:
+					return false, nil
+				}
+				return true, nil
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			var buf strings.Builder
+			if format {
+				if len(args) == 0 {
+					return nil, ErrUsage
+				}
+				operands := make([]any, len(args)-1)
+				for i, arg := range args[1:] {
+					operands[i] = arg
+				}
+				fmt.Fprintf(&buf, args[0], operands...)
+			} else {
+				for i, arg := range args {
+					if i > 0 {
+						buf.WriteString(" ")
+					}
+					buf.WriteString(arg)
+				}
+			}
+			if newline {
+				buf.WriteString("\n")
+			}
+			out := buf.String()
+
+			// Stuff the result into a callback to satisfy the OutputCommandFunc
+			// interface, even though it isn't really asynchronous even if run in the
+			// background.
+			//
+			// Nobody should be running 'echo' as a background command, but it's not worth
 			// defining yet another interface, and also doesn't seem worth shoehorning
 			// into a SimpleCommand the way we did with Wait.
 			return func(*State) (stdout, stderr string, err error) {
@@ -355,17 +1200,57 @@ func Echo() Cmd {
 // With no arguments, Env reports all variables in the environment.
 // "key=value" arguments set variables, and arguments without "="
 // cause the corresponding value to be printed to the stdout buffer.
+// With the -u flag, the named variables are instead removed.
+// With the -json flag, the environment is printed as a JSON object.
 func Env() Cmd {
 	return Command(
 		CmdUsage{
 			Summary: "set or log the values of environment variables",
-			Args:    "[key[=value]...]",
+			Args:    "[-json | -u key... | key[=value]...]",
 			Detail: []string{
 				"With no arguments, print the script environment to the log.",
 				"Otherwise, add the listed key=value pairs to the environment or print the listed keys.",
+				"With -u, remove the listed keys from the environment instead. Removing an unset key is not an error.",
+				"With -json, print the script environment to stdout as a JSON object with sorted keys.",
 			},
+			ReadOnly: true,
 		},
 		func(s *State, args ...string) (WaitFunc, error) {
+			if len(args) > 0 && args[0] == "-json" {
+				if len(args) > 1 {
+					return nil, ErrUsage
+				}
+				m := make(map[string]string, len(s.env))
+				for _, kv := range s.env {
+					if k, v, ok := strings.Cut(kv, "="); ok {
+						m[k] = v
+					}
+				}
+				// encoding/json sorts map keys, so the output is deterministic.
+				data, err := json.MarshalIndent(m, "", "\t")
+				if err != nil {
+					return nil, err
+				}
+				return func(*State) (stdout, stderr string, err error) {
+					return string(data) + "\n", "", nil
+				}, nil
+			}
+
+			if len(args) > 0 && args[0] == "-u" {
+				if len(args) == 1 {
+					return nil, ErrUsage
+				}
+				for _, key := range args[1:] {
+					if key == "" || strings.Contains(key, "=") {
+						return nil, ErrUsage
+					}
+					if err := s.Unsetenv(key); err != nil {
+						return nil, err
+					}
+				}
+				return nil, nil
+			}
+
 			out := new(strings.Builder)
 			if len(args) == 0 {
 				for _, kv := range s.env {
@@ -403,13 +1288,55 @@ func Exec(cancel func(*exec.Cmd) error, waitDelay time.Duration) Cmd {
 	return Command(
 		CmdUsage{
 			Summary: "run an executable program with arguments",
-			Args:    "program [args...]",
+			Args:    "[-status=var] [-env=KEY=VALUE...] [-stdout=file] [-stderr=file] [-append] program [args...]",
 			Detail: []string{
 				"Note that 'exec' does not terminate the script (unlike Unix shells).",
+				"Each -env flag sets an environment variable for the program only, overriding any value in the script's environment. The program is still located using the script's PATH.",
+				"With -stdout or -stderr, the corresponding output of the program is written directly to the named file instead of the script's stdout or stderr buffer, which is left empty. The file is truncated first, unless -append is also given. Output written to a file is not subject to the engine's limit on captured output.",
+				"With -status=var, the program's exit status is stored in the variable var and a nonzero status does not cause the command to fail. A program terminated by a signal has status -1.",
 			},
 			Async: true,
 		},
 		func(s *State, args ...string) (WaitFunc, error) {
+			var (
+				statusVar              string
+				env                    []string
+				stdoutFile, stderrFile string
+				appendOutput           bool
+			)
+			args, err := ParseFlags(args, func(flag string) (bool, error) {
+				switch {
+				case strings.HasPrefix(flag, "-stdout="):
+					stdoutFile = strings.TrimPrefix(flag, "-stdout=")
+					if stdoutFile == "" {
+						return false, ErrUsage
+					}
+				case strings.HasPrefix(flag, "-stderr="):
+					stderrFile = strings.TrimPrefix(flag, "-stderr=")
+					if stderrFile == "" {
+						return false, ErrUsage
+					}
+				case flag == "-append":
+					appendOutput = true
+				case strings.HasPrefix(flag, "-status="):
+					statusVar = strings.TrimPrefix(flag, "-status=")
+					if statusVar == "" || strings.Contains(statusVar, "=") {
+						return false, ErrUsage
+					}
+				case strings.HasPrefix(flag, "-env="):
+					kv := strings.TrimPrefix(flag, "-env=")
+					if k, _, ok := strings.Cut(kv, "="); !ok || k == "" {
+						return false, ErrUsage
+					}
+					env = append(env, kv)
+				default:
+					return false, nil
+				}
+				return true, nil
+			})
+			if err != nil {
+				return nil, err
+			}
 			if len(args) < 1 {
 				return nil, ErrUsage
 			}
@@ -420,22 +1347,127 @@ func Exec(cancel func(*exec.Cmd) error, waitDelay time.Duration) Cmd {
 			name := filepath.FromSlash(args[0])
 			path := name
 			if !strings.Contains(name, string(filepath.Separator)) {
-				var err error
 				path, err = lookPath(s, name)
 				if err != nil {
 					return nil, err
 				}
 			}
 
-			return startCommand(s, name, path, args[1:], cancel, waitDelay)
+			var opts execOptions
+			if env != nil {
+				opts.env = cleanEnv(append(s.Environ(), env...), s.Getwd())
+			}
+			files, err := openOutputFiles(s, &opts, stdoutFile, stderrFile, appendOutput)
+			if err != nil {
+				return nil, err
+			}
+			wait, err := startCommand(s, name, path, args[1:], opts, cancel, waitDelay)
+			if err != nil {
+				closeFiles(files)
+				return nil, err
+			}
+			if files != nil {
+				w := wait
+				wait = func(s *State) (stdout, stderr string, err error) {
+					stdout, stderr, err = w(s)
+					if closeErr := closeFiles(files); err == nil {
+						err = closeErr
+					}
+					return stdout, stderr, err
+				}
+			}
+			if statusVar == "" {
+				return wait, nil
+			}
+			return func(s *State) (stdout, stderr string, err error) {
+				stdout, stderr, err = wait(s)
+				code := 0
+				if ee := (*exec.ExitError)(nil); errors.As(err, &ee) {
+					code = ee.ExitCode()
+					err = nil
+				}
+				if err == nil {
+					err = s.Setenv(statusVar, strconv.Itoa(code))
+				}
+				return stdout, stderr, err
+			}, nil
 		})
 }
 
-func startCommand(s *State, name, path string, args []string, cancel func(*exec.Cmd) error, waitDelay time.Duration) (WaitFunc, error) {
+// openOutputFiles opens the files named by the -stdout and -stderr flags of
+// exec, if any, and sets the corresponding writers in opts. A file named by
+// both flags is opened only once. The caller must close the returned files.
+func openOutputFiles(s *State, opts *execOptions, stdoutFile, stderrFile string, appendOutput bool) ([]*os.File, error) {
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appendOutput {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	var files []*os.File
+	open := func(name string) (*os.File, error) {
+		path, err := s.ResolvePath(name)
+		if err != nil {
+			closeFiles(files)
+			return nil, err
+		}
+		f, err := os.OpenFile(path, flag, 0666)
+		if err != nil {
+			closeFiles(files)
+			return nil, err
+		}
+		files = append(files, f)
+		return f, nil
+	}
+
+	if stdoutFile != "" {
+		f, err := open(stdoutFile)
+		if err != nil {
+			return nil, err
+		}
+		opts.stdout = f
+	}
+	if stderrFile != "" {
+		if stderrFile == stdoutFile {
+			opts.stderr = opts.stdout
+		} else {
+			f, err := open(stderrFile)
+			if err != nil {
+				return nil, err
+			}
+			opts.stderr = f
+		}
+	}
+	return files, nil
+}
+
+// closeFiles closes each of files, returning the first error encountered.
+func closeFiles(files []*os.File) error {
+	var firstErr error
+	for _, f := range files {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// execOptions holds optional settings for startCommand.
+type execOptions struct {
+	env            []string  // if non-nil, the environment of the process instead of the script's
+	stdout, stderr io.Writer // if non-nil, receive the process's output instead of the returned WaitFunc
+}
+
+func startCommand(s *State, name, path string, args []string, opts execOptions, cancel func(*exec.Cmd) error, waitDelay time.Duration) (WaitFunc, error) {
 	var (
 		cmd                  *exec.Cmd
-		stdoutBuf, stderrBuf strings.Builder
+		stdoutBuf, stderrBuf limitedBuffer
 	)
+	if s.engine != nil {
+		if s.engine.Sandbox && !s.engine.SandboxExec {
+			return nil, fmt.Errorf("cannot run %s: programs are not allowed in the sandbox", name)
+		}
+		stdoutBuf.limit = s.engine.MaxOutputBytes
+		stderrBuf.limit = s.engine.MaxOutputBytes
+	}
 	for {
 		cmd = exec.CommandContext(s.Context(), path, args...)
 		if cancel == nil {
@@ -447,8 +1479,20 @@ func startCommand(s *State, name, path string, args []string, cancel func(*exec.
 		cmd.Args[0] = name
 		cmd.Dir = s.Getwd()
 		cmd.Env = s.env
+		if opts.env != nil {
+			cmd.Env = opts.env
+		}
+		if s.hasStdin {
+			cmd.Stdin = strings.NewReader(s.stdin)
+		}
 		cmd.Stdout = &stdoutBuf
+		if opts.stdout != nil {
+			cmd.Stdout = opts.stdout
+		}
 		cmd.Stderr = &stderrBuf
+		if opts.stderr != nil {
+			cmd.Stderr = opts.stderr
+		}
 		err := cmd.Start()
 		if err == nil {
 			break
@@ -465,13 +1509,47 @@ func startCommand(s *State, name, path string, args []string, cancel func(*exec.
 		}
 	}
 
+	s.stdin, s.hasStdin = "", false
+
 	wait := func(s *State) (stdout, stderr string, err error) {
 		err = cmd.Wait()
+		for _, b := range []struct {
+			name string
+			buf  *limitedBuffer
+		}{{"stdout", &stdoutBuf}, {"stderr", &stderrBuf}} {
+			if b.buf.truncated {
+				// The process may have failed only because its output was cut off,
+				// so report the truncation instead.
+				err = fmt.Errorf("%s truncated after reaching limit of %d bytes (Engine.MaxOutputBytes)", b.name, b.buf.limit)
+				break
+			}
+		}
 		return stdoutBuf.String(), stderrBuf.String(), err
 	}
 	return wait, nil
 }
 
+// A limitedBuffer is an io.Writer that accumulates up to limit bytes (or an
+// unlimited number, if limit <= 0) and fails any write that would exceed it.
+type limitedBuffer struct {
+	b         strings.Builder
+	limit     int
+	truncated bool // a write was cut off at the limit
+}
+
+var errOutputLimit = errors.New("output limit exceeded")
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.limit > 0 && b.b.Len()+len(p) > b.limit {
+		n, _ := b.b.Write(p[:b.limit-b.b.Len()])
+		b.truncated = true
+		return n, errOutputLimit
+	}
+	return b.b.Write(p)
+}
+
+func (b *limitedBuffer) String() string { return b.b.String() }
+
 // lookPath is (roughly) like exec.LookPath, but it uses the script's current
 // PATH to find the executable.
 func lookPath(s *State, command string) (string, error) {
@@ -565,30 +1643,35 @@ func pathEnvName() string {
 func Exists() Cmd {
 	return Command(
 		CmdUsage{
-			Summary: "check that files exist",
-			Args:    "[-readonly] [-exec] file...",
+			Summary:  "check that files exist",
+			Args:     "[-readonly] [-exec] file...",
+			ReadOnly: true,
 		},
 		func(s *State, args ...string) (WaitFunc, error) {
 			var readonly, exec bool
-		loop:
-			for len(args) > 0 {
-				switch args[0] {
+			args, err := ParseFlags(args, func(flag string) (bool, error) {
+				switch flag {
 				case "-readonly":
 					readonly = true
-					args = args[1:]
 				case "-exec":
 					exec = true
-					args = args[1:]
 				default:
-					break loop
+					return false, nil
 				}
+				return true, nil
+			})
+			if err != nil {
+				return nil, err
 			}
 			if len(args) == 0 {
 				return nil, ErrUsage
 			}
 
 			for _, file := range args {
-				file = s.Path(file)
+				file, err := s.ResolvePath(file)
+				if err != nil {
+					return nil, err
+				}
 				info, err := os.Stat(file)
 				if err != nil {
 					return nil, err
@@ -605,86 +1688,421 @@ func Exists() Cmd {
 		})
 }
 
-// Grep checks that file content matches a regexp.
-// Like stdout/stderr and unlike Unix grep, it accepts Go regexp syntax.
-//
-// Grep does not modify the State's stdout or stderr buffers.
-// (Its output goes to the script log, not stdout.)
-func Grep() Cmd {
+// Expect checks a comparison between two values.
+func Expect() Cmd {
 	return Command(
 		CmdUsage{
-			Summary: "find lines in a file that match a pattern",
-			Args:    matchUsage + " file",
+			Summary: "check a comparison between two values",
+			Args:    "value1 op value2",
 			Detail: []string{
-				"The command succeeds if at least one match (or the exact count, if given) is found.",
-				"The -q flag suppresses printing of matches.",
+				"Succeeds if the comparison is true. The operators == and != compare strings; -eq, -ne, -lt, -le, -gt, and -ge compare integers, and fail with an error if either value is not one.",
+				"The values are typically expanded variables, such as those assigned from the output of an earlier command.",
 			},
-			RegexpArgs: firstNonFlag,
+			ReadOnly: true,
 		},
 		func(s *State, args ...string) (WaitFunc, error) {
-			return nil, match(s, args, "", "grep")
+			if len(args) != 3 {
+				return nil, ErrUsage
+			}
+			x, op, y := args[0], args[1], args[2]
+
+			var ok bool
+			switch op {
+			case "==":
+				ok = x == y
+			case "!=":
+				ok = x != y
+			case "-eq", "-ne", "-lt", "-le", "-gt", "-ge":
+				i, err := strconv.ParseInt(x, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %q is not an integer", op, x)
+				}
+				j, err := strconv.ParseInt(y, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %q is not an integer", op, y)
+				}
+				switch op {
+				case "-eq":
+					ok = i == j
+				case "-ne":
+					ok = i != j
+				case "-lt":
+					ok = i < j
+				case "-le":
+					ok = i <= j
+				case "-gt":
+					ok = i > j
+				case "-ge":
+					ok = i >= j
+				}
+			default:
+				return nil, fmt.Errorf("unknown operator %q", op)
+			}
+			if !ok {
+				return nil, fmt.Errorf("%q %s %q is false", x, op, y)
+			}
+			return nil, nil
 		})
 }
 
-const matchUsage = "[-count=N] [-q] 'pattern'"
-
-// match implements the Grep, Stdout, and Stderr commands.
-func match(s *State, args []string, text, name string) error {
-	n := 0
-	if len(args) >= 1 && strings.HasPrefix(args[0], "-count=") {
-		var err error
-		n, err = strconv.Atoi(args[0][len("-count="):])
-		if err != nil {
-			return fmt.Errorf("bad -count=: %v", err)
-		}
-		if n < 1 {
-			return fmt.Errorf("bad -count=: must be at least 1")
-		}
-		args = args[1:]
-	}
-	quiet := false
-	if len(args) >= 1 && args[0] == "-q" {
-		quiet = true
-		args = args[1:]
-	}
+// Find lists the files in a directory tree.
+func Find() Cmd {
+	return Command(
+		CmdUsage{
+			Summary: "list files in a directory tree",
+			Args:    "[-name=glob] [-type=f|d|l] dir",
+			Detail: []string{
+				"Walks the tree rooted at dir and writes the path of each file or directory within it, relative to dir and using forward slashes, to stdout, one per line in sorted order. Dir itself is not listed.",
+				"With -name, only entries whose base names match the glob pattern (as with path.Match) are listed. With -type, only regular files (f), directories (d), or symbolic links (l) are listed.",
+				"Symbolic links are listed but not followed.",
+			},
+			ReadOnly: true,
+		},
+		func(s *State, args ...string) (WaitFunc, error) {
+			var name, typ string
+			args, err := ParseFlags(args, func(flag string) (bool, error) {
+				switch {
+				case strings.HasPrefix(flag, "-name="):
+					name = flag[len("-name="):]
+					if _, err := path.Match(name, ""); err != nil {
+						return false, fmt.Errorf("bad -name=: %v", err)
+					}
+				case strings.HasPrefix(flag, "-type="):
+					typ = flag[len("-type="):]
+					if typ != "f" && typ != "d" && typ != "l" {
+						return false, fmt.Errorf("bad -type=%s: must be f, d, or l", typ)
+					}
+				default:
+					return false, nil
+				}
+				return true, nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			if len(args) != 1 {
+				return nil, ErrUsage
+			}
 
-	isGrep := name == "grep"
+			root, err := s.ResolvePath(args[0])
+			if err != nil {
+				return nil, err
+			}
+			var found []string
+			err = filepath.WalkDir(root, func(file string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if file == root {
+					return nil
+				}
+				if name != "" {
+					if ok, _ := path.Match(name, d.Name()); !ok {
+						return nil
+					}
+				}
+				switch typ {
+				case "f":
+					if !d.Type().IsRegular() {
+						return nil
+					}
+				case "d":
+					if !d.IsDir() {
+						return nil
+					}
+				case "l":
+					if d.Type()&fs.ModeSymlink == 0 {
+						return nil
+					}
+				}
+				rel, err := filepath.Rel(root, file)
+				if err != nil {
+					return err
+				}
+				found = append(found, filepath.ToSlash(rel))
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			sort.Strings(found)
 
-	wantArgs := 1
-	if isGrep {
-		wantArgs = 2
-	}
-	if len(args) != wantArgs {
-		return ErrUsage
-	}
+			var out strings.Builder
+			for _, f := range found {
+				out.WriteString(f)
+				out.WriteString("\n")
+			}
+			return func(*State) (stdout, stderr string, err error) {
+				return out.String(), "", nil
+			}, nil
+		})
+}
 
-	pattern := `(?m)` + args[0]
+// Gen writes a sequence of numbered files.
+func Gen() Cmd {
+	return Command(
+		CmdUsage{
+			Summary: "generate numbered files",
+			Args:    "-n=N -name=format [-content=format]",
+			Detail: []string{
+				"Writes N files, numbered 1 through N, creating any missing parent directories. The name and content of each file are the given formats with each %d verb replaced by its number. The verbs may have flags and a width, as in %03d, and %% is a literal %. No other verbs are allowed, and a format need not have any.",
+				"Each file contains the formatted content followed by a newline, or is empty if -content is omitted. The names must all be distinct.",
+			},
+		},
+		func(s *State, args ...string) (WaitFunc, error) {
+			var (
+				n             int
+				name, content string
+				hasContent    bool
+			)
+			args, err := ParseFlags(args, func(flag string) (bool, error) {
+				switch {
+				case strings.HasPrefix(flag, "-n="):
+					var err error
+					n, err = strconv.Atoi(flag[len("-n="):])
+					if err != nil {
+						return false, fmt.Errorf("bad -n=: %v", err)
+					}
+					if n <= 0 {
+						return false, fmt.Errorf("bad -n=: must be positive")
+					}
+				case strings.HasPrefix(flag, "-name="):
+					name = flag[len("-name="):]
+				case strings.HasPrefix(flag, "-content="):
+					content = flag[len("-content="):]
+					hasContent = true
+				default:
+					return false, nil
+				}
+				return true, nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			if len(args) > 0 {
+				return nil, ErrUsage
+			}
+			if n == 0 {
+				return nil, fmt.Errorf("missing -n=N")
+			}
+			if name == "" {
+				return nil, fmt.Errorf("missing -name=format")
+			}
+			nameVerbs, err := genVerbs(name)
+			if err != nil {
+				return nil, fmt.Errorf("bad -name=: %v", err)
+			}
+			contentVerbs := 0
+			if hasContent {
+				contentVerbs, err = genVerbs(content)
+				if err != nil {
+					return nil, fmt.Errorf("bad -content=: %v", err)
+				}
+			}
+
+			files := make(map[string]string, n)
+			for i := 1; i <= n; i++ {
+				file := genFormat(name, nameVerbs, i)
+				if _, ok := files[file]; ok {
+					return nil, fmt.Errorf("bad -name=: generates %s more than once", file)
+				}
+				data := ""
+				if hasContent {
+					data = genFormat(content, contentVerbs, i) + "\n"
+				}
+				files[file] = data
+			}
+
+			for file, data := range files {
+				path, err := s.ResolvePath(file)
+				if err != nil {
+					return nil, err
+				}
+				if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+					return nil, err
+				}
+				if err := os.WriteFile(path, []byte(data), 0666); err != nil {
+					return nil, err
+				}
+			}
+			return nil, nil
+		})
+}
+
+// genVerbs returns the number of verbs in format, reporting an error if any of
+// them is not a %d verb (possibly with flags and a width) or a literal %%.
+func genVerbs(format string) (int, error) {
+	n := 0
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		j := i + 1
+		for j < len(format) && strings.IndexByte("+-# 0123456789", format[j]) >= 0 {
+			j++
+		}
+		switch {
+		case j == len(format):
+			return 0, fmt.Errorf("incomplete verb %q at end of format", format[i:])
+		case format[j] == '%' && j == i+1:
+			// A literal percent sign.
+		case format[j] == 'd':
+			n++
+		default:
+			return 0, fmt.Errorf("unsupported verb %q; only %%d is allowed", format[i:j+1])
+		}
+		i = j
+	}
+	return n, nil
+}
+
+// genFormat formats i according to format, which contains the given number of
+// %d verbs.
+func genFormat(format string, verbs, i int) string {
+	operands := make([]any, verbs)
+	for k := range operands {
+		operands[k] = i
+	}
+	return fmt.Sprintf(format, operands...)
+}
+
+// Grep checks that file content matches a regexp.
+// Like stdout/stderr and unlike Unix grep, it accepts Go regexp syntax.
+//
+// Grep does not modify the State's stdout or stderr buffers.
+// (Its output goes to the script log, not stdout.)
+func Grep() Cmd {
+	return Command(
+		CmdUsage{
+			Summary: "find lines in a file that match a pattern",
+			Args:    matchUsage + " file",
+			Detail: []string{
+				"The command succeeds if at least one match (or the exact count, if given) is found.",
+				"Matches are counted without overlap, and -count=0 succeeds only if there is no match.",
+				"The -q flag suppresses printing of matches.",
+				"With -expand, environment variables in the pattern are expanded (with regular expression metacharacters in their values quoted), even if the pattern is quoted.",
+				"If there is no match, -A=N and -B=N print N lines of context after and before the line that contains the most literal text from the pattern, if any.",
+				"With -o, each match (or, with -group=N, the text of its Nth parenthesized subexpression) is written to the stdout buffer on a line of its own instead.",
+			},
+			RegexpArgs: firstNonFlag,
+			ReadOnly:   true,
+		},
+		func(s *State, args ...string) (WaitFunc, error) {
+			return match(s, args, "", "grep")
+		})
+}
+
+const matchUsage = "[-count=N] [-q] [-expand] [-A=N] [-B=N] [-o [-group=N]] 'pattern'"
+
+// match implements the Grep, Stdout, and Stderr commands.
+func match(s *State, args []string, text, name string) (WaitFunc, error) {
+	n := -1
+	quiet := false
+	expand := false
+	only, group := false, -1
+	after, before := 0, 0
+	args, err := ParseFlags(args, func(flag string) (bool, error) {
+		switch {
+		case strings.HasPrefix(flag, "-count="):
+			var err error
+			n, err = strconv.Atoi(flag[len("-count="):])
+			if err != nil {
+				return false, fmt.Errorf("bad -count=: %v", err)
+			}
+			if n < 0 {
+				return false, fmt.Errorf("bad -count=: must be non-negative")
+			}
+		case strings.HasPrefix(flag, "-A="), strings.HasPrefix(flag, "-B="):
+			name, v, _ := strings.Cut(flag, "=")
+			c, err := strconv.Atoi(v)
+			if err != nil {
+				return false, fmt.Errorf("bad %s=: %v", name, err)
+			}
+			if c < 0 {
+				return false, fmt.Errorf("bad %s=: must be non-negative", name)
+			}
+			if name == "-A" {
+				after = c
+			} else {
+				before = c
+			}
+		case flag == "-q":
+			quiet = true
+		case flag == "-expand":
+			expand = true
+		case flag == "-o":
+			only = true
+		case strings.HasPrefix(flag, "-group="):
+			var err error
+			group, err = strconv.Atoi(flag[len("-group="):])
+			if err != nil {
+				return false, fmt.Errorf("bad -group=: %v", err)
+			}
+			if group < 0 {
+				return false, fmt.Errorf("bad -group=: must be non-negative")
+			}
+		default:
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	isGrep := name == "grep"
+
+	wantArgs := 1
+	if isGrep {
+		wantArgs = 2
+	}
+	if len(args) != wantArgs || (group >= 0 && !only) {
+		return nil, ErrUsage
+	}
+
+	pattern := args[0]
+	if expand {
+		pattern = s.ExpandEnv(pattern, true)
+	}
+	pattern = `(?m)` + pattern
 	re, err := regexp.Compile(pattern)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if group > re.NumSubexp() {
+		return nil, fmt.Errorf("bad -group=%d: pattern %#q has only %d parenthesized subexpressions", group, pattern, re.NumSubexp())
 	}
 
 	if isGrep {
 		name = args[1] // for error messages
-		data, err := os.ReadFile(s.Path(args[1]))
+		data, err := s.ReadFile(args[1])
 		if err != nil {
-			return err
+			return nil, err
 		}
 		text = string(data)
 	}
 
-	if n > 0 {
+	if n >= 0 {
 		count := len(re.FindAllString(text, -1))
 		if count != n {
-			return fmt.Errorf("found %d matches for %#q in %s", count, pattern, name)
+			return nil, fmt.Errorf("found %d matches for %#q in %s", count, pattern, name)
 		}
-		return nil
+		if only {
+			return matchedText(re, text, group), nil
+		}
+		return nil, nil
 	}
 
 	if !re.MatchString(text) {
-		return fmt.Errorf("no match for %#q in %s", pattern, name)
+		if after > 0 || before > 0 {
+			logNearMiss(s, re, text, before, after)
+		}
+		return nil, fmt.Errorf("no match for %#q in %s", pattern, name)
 	}
 
+	if only {
+		return matchedText(re, text, group), nil
+	}
 	if !quiet {
 		// Print the lines containing the match.
 		loc := re.FindStringIndex(text)
@@ -697,7 +2115,271 @@ func match(s *State, args []string, text, name string) error {
 		lines := strings.TrimSuffix(text[loc[0]:loc[1]], "\n")
 		s.Logf("matched: %s\n", lines)
 	}
-	return nil
+	return nil, nil
+}
+
+// matchedText returns a WaitFunc that writes to stdout each match of re in
+// text, or the given subexpression of each match if group is non-negative,
+// one per line.
+func matchedText(re *regexp.Regexp, text string, group int) WaitFunc {
+	if group < 0 {
+		group = 0
+	}
+	var b strings.Builder
+	for _, m := range re.FindAllStringSubmatch(text, -1) {
+		b.WriteString(m[group])
+		b.WriteString("\n")
+	}
+	out := b.String()
+	return func(*State) (stdout, stderr string, err error) {
+		return out, "", nil
+	}
+}
+
+// logNearMiss logs the line of text that contains the most literal text from
+// the pattern of re (which failed to match), along with up to before and
+// after lines of context around it.
+func logNearMiss(s *State, re *regexp.Regexp, text string, before, after int) {
+	parsed, err := syntax.Parse(re.String(), syntax.Perl)
+	if err != nil {
+		return
+	}
+	type literal struct {
+		s    string
+		fold bool // s is lower case and matches case-insensitively
+	}
+	var lits []literal
+	var walk func(*syntax.Regexp)
+	walk = func(r *syntax.Regexp) {
+		if r.Op == syntax.OpLiteral {
+			lit := literal{s: string(r.Rune), fold: r.Flags&syntax.FoldCase != 0}
+			if lit.fold {
+				lit.s = strings.ToLower(lit.s)
+			}
+			lits = append(lits, lit)
+		}
+		for _, sub := range r.Sub {
+			walk(sub)
+		}
+	}
+	walk(parsed)
+
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	best, bestScore := -1, 0
+	for i, line := range lines {
+		score := 0
+		lower := strings.ToLower(line)
+		for _, lit := range lits {
+			if lit.fold && strings.Contains(lower, lit.s) || !lit.fold && strings.Contains(line, lit.s) {
+				score += len(lit.s)
+			}
+		}
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	if best < 0 {
+		s.Logf("no partial match\n")
+		return
+	}
+
+	first, last := best-before, best+after
+	if first < 0 {
+		first = 0
+	}
+	if last >= len(lines) {
+		last = len(lines) - 1
+	}
+	s.Logf("nearest partial match (line %d):\n", best+1)
+	for i := first; i <= last; i++ {
+		mark := " "
+		if i == best {
+			mark = ">"
+		}
+		s.Logf("%s %d: %s\n", mark, i+1, lines[i])
+	}
+}
+
+// Hash computes the digest of a file, or of the stdout or stderr buffer.
+func Hash() Cmd {
+	return Command(
+		CmdUsage{
+			Summary: "compute or check the digest of a file",
+			Args:    "-sha256[=HEX] | -sha1[=HEX] | -md5[=HEX] file",
+			Detail: []string{
+				"Computes the digest of file using the given algorithm.",
+				"With =HEX, the command succeeds if the digest, in hexadecimal, is HEX (in either case) and fails otherwise, leaving the stdout buffer unchanged. Without it, the digest is written to the stdout buffer in lowercase hexadecimal.",
+				"The file may be 'stdout' or 'stderr' to compute the digest of the script's stdout or stderr buffer.",
+			},
+			ReadOnly: true,
+		},
+		func(s *State, args ...string) (WaitFunc, error) {
+			var (
+				h          hash.Hash
+				flag, want string
+				hasWant    bool
+			)
+			args, err := ParseFlags(args, func(arg string) (bool, error) {
+				if h != nil {
+					return false, ErrUsage
+				}
+				flag, want, hasWant = strings.Cut(arg, "=")
+				switch flag {
+				case "-sha256":
+					h = sha256.New()
+				case "-sha1":
+					h = sha1.New()
+				case "-md5":
+					h = md5.New()
+				default:
+					return false, nil
+				}
+				return true, nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			if h == nil || len(args) != 1 {
+				return nil, ErrUsage
+			}
+
+			name := args[0]
+			text, err := readFileOrBuffer(s, name)
+			if err != nil {
+				return nil, err
+			}
+			h.Write([]byte(text))
+			sum := hex.EncodeToString(h.Sum(nil))
+
+			if hasWant {
+				if !strings.EqualFold(sum, want) {
+					return nil, fmt.Errorf("%s digest of %s is %s, want %s", flag[1:], name, sum, want)
+				}
+				return nil, nil
+			}
+			return func(*State) (stdout, stderr string, err error) {
+				return sum + "\n", "", nil
+			}, nil
+		})
+}
+
+// Head truncates a file, or the stdout or stderr buffer, to its first lines.
+func Head() Cmd {
+	return Command(
+		CmdUsage{
+			Summary: "keep only the first lines of a file",
+			Args:    "[-n=N] [-stdout] file",
+			Detail: []string{
+				"Replaces the contents of file with its first N lines (10 by default). If the file has fewer lines, it is left unchanged.",
+				linesFileDetail,
+			},
+		},
+		func(s *State, args ...string) (WaitFunc, error) {
+			n, toStdout, name, err := parseLineCount(args)
+			if err != nil {
+				return nil, err
+			}
+			return filterLines(s, name, toStdout, func(lines []string) []string {
+				if n < len(lines) {
+					lines = lines[:n]
+				}
+				return lines
+			})
+		})
+}
+
+// linesFileDetail describes the file argument of commands that use filterLines.
+const linesFileDetail = "The file may be 'stdout' or 'stderr' to operate on the script's stdout or stderr buffer. With -stdout, the file is left unchanged and the result is written to the stdout buffer instead."
+
+// parseLineCount parses the arguments of the head and tail commands.
+func parseLineCount(args []string) (n int, toStdout bool, name string, err error) {
+	n = 10
+	args, err = ParseFlags(args, func(flag string) (bool, error) {
+		switch {
+		case flag == "-stdout":
+			toStdout = true
+		case strings.HasPrefix(flag, "-n="):
+			n, err = strconv.Atoi(flag[len("-n="):])
+			if err != nil {
+				return false, fmt.Errorf("bad -n=: %v", err)
+			}
+			if n < 0 {
+				return false, fmt.Errorf("bad -n=: must be non-negative")
+			}
+		default:
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		return 0, false, "", err
+	}
+	if len(args) != 1 {
+		return 0, false, "", ErrUsage
+	}
+	return n, toStdout, args[0], nil
+}
+
+// filterLines applies f to the lines of the named file and writes back the
+// resulting lines.
+//
+// The file may be "stdout" or "stderr" to filter the corresponding buffer.
+// If toStdout is true, the result is instead returned as the command's stdout
+// and the file is left unchanged.
+func filterLines(s *State, name string, toStdout bool, f func([]string) []string) (WaitFunc, error) {
+	return filterText(s, name, toStdout, func(text string) string {
+		trailingNewline := strings.HasSuffix(text, "\n")
+		var lines []string
+		if text != "" {
+			lines = strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+		}
+		lines = f(lines)
+		out := strings.Join(lines, "\n")
+		if len(lines) > 0 && trailingNewline {
+			out += "\n"
+		}
+		return out
+	})
+}
+
+// readFileOrBuffer returns the contents of the named file, or of the stdout
+// or stderr buffer if name is "stdout" or "stderr".
+func readFileOrBuffer(s *State, name string) (string, error) {
+	switch name {
+	case "stdout":
+		return s.Stdout(), nil
+	case "stderr":
+		return s.Stderr(), nil
+	}
+	data, err := s.ReadFile(name)
+	return string(data), err
+}
+
+// filterText is like filterLines, but f is applied to the entire text of the
+// file at once.
+func filterText(s *State, name string, toStdout bool, f func(string) string) (WaitFunc, error) {
+	text, err := readFileOrBuffer(s, name)
+	if err != nil {
+		return nil, err
+	}
+
+	out := f(text)
+	if toStdout {
+		return func(*State) (stdout, stderr string, err error) {
+			return out, "", nil
+		}, nil
+	}
+	switch name {
+	case "stdout":
+		s.stdout = out
+	case "stderr":
+		s.stderr = out
+	default:
+		if err := s.WriteFile(name, []byte(out), 0666); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
 }
 
 // Help writes command documentation to the script log.
@@ -710,6 +2392,7 @@ func Help() Cmd {
 				"To display help for a specific condition, enclose it in brackets: 'help [amd64]'.",
 				"To display complete documentation when listing all commands, pass the -v flag.",
 			},
+			ReadOnly: true,
 		},
 		func(s *State, args ...string) (WaitFunc, error) {
 			if s.engine == nil {
@@ -756,6 +2439,35 @@ func Help() Cmd {
 		})
 }
 
+// Kill stops named background commands.
+func Kill() Cmd {
+	return Command(
+		CmdUsage{
+			Summary: "stop named background commands",
+			Args:    "name...",
+			Detail: []string{
+				"Cancels the Context of each background command started with -bg=name. For 'exec', this sends the program the interrupt signal configured for the script engine.",
+				"The commands must still be reaped by 'wait'. The exit status of a killed command is logged but does not cause 'wait' to fail.",
+			},
+		},
+		func(s *State, args ...string) (WaitFunc, error) {
+			if len(args) == 0 {
+				return nil, ErrUsage
+			}
+			for _, name := range args {
+				if _, ok := s.named[name]; !ok {
+					return nil, fmt.Errorf("no background command named %q", name)
+				}
+			}
+			for _, name := range args {
+				bg := s.named[name]
+				bg.killed = true
+				bg.cancel()
+			}
+			return nil, nil
+		})
+}
+
 // Mkdir creates a directory and any needed parent directories.
 func Mkdir() Cmd {
 	return Command(
@@ -771,7 +2483,11 @@ func Mkdir() Cmd {
 				return nil, ErrUsage
 			}
 			for _, arg := range args {
-				if err := os.MkdirAll(s.Path(arg), 0777); err != nil {
+				path, err := s.ResolvePath(arg)
+				if err != nil {
+					return nil, err
+				}
+				if err := os.MkdirAll(path, 0777); err != nil {
 					return nil, err
 				}
 			}
@@ -779,29 +2495,132 @@ func Mkdir() Cmd {
 		})
 }
 
-// Mv renames an existing file or directory to a new path.
-func Mv() Cmd {
+// Mktemp creates a new temporary file or directory with a unique name and
+// stores its path in an environment variable.
+func Mktemp() Cmd {
 	return Command(
 		CmdUsage{
-			Summary: "rename a file or directory to a new path",
-			Args:    "old new",
+			Summary: "create a temporary file or directory",
+			Args:    "[-d] var",
 			Detail: []string{
-				"OS-specific restrictions may apply when old and new are in different directories.",
+				"Creates an empty file (or, with -d, a directory) with a unique name within the script's initial working directory, and sets the variable var to its absolute path.",
+				"Each invocation creates a new path. The path is removed when the script completes.",
 			},
 		},
 		func(s *State, args ...string) (WaitFunc, error) {
-			if len(args) != 2 {
+			dir := false
+			args, err := ParseFlags(args, func(flag string) (bool, error) {
+				if flag != "-d" {
+					return false, nil
+				}
+				dir = true
+				return true, nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			if len(args) != 1 || args[0] == "" || strings.Contains(args[0], "=") {
 				return nil, ErrUsage
 			}
-			return nil, os.Rename(s.Path(args[0]), s.Path(args[1]))
+
+			var path string
+			if dir {
+				var err error
+				path, err = os.MkdirTemp(s.workdir, "tmp")
+				if err != nil {
+					return nil, err
+				}
+			} else {
+				f, err := os.CreateTemp(s.workdir, "tmp")
+				if err != nil {
+					return nil, err
+				}
+				path = f.Name()
+				if err := f.Close(); err != nil {
+					return nil, err
+				}
+			}
+			s.tempPaths = append(s.tempPaths, path)
+			return nil, s.Setenv(args[0], path)
 		})
 }
 
-// Program returns a new command that runs the named program, found from the
-// host process's PATH (not looked up in the script's PATH).
-func Program(name string, cancel func(*exec.Cmd) error, waitDelay time.Duration) Cmd {
-	var (
-		shortName    string
+// Mv renames an existing file or directory to a new path.
+func Mv() Cmd {
+	return Command(
+		CmdUsage{
+			Summary: "rename a file or directory to a new path",
+			Args:    "[-f] old new",
+			Detail: []string{
+				"OS-specific restrictions may apply when old and new are in different directories.",
+				"If old and new are on different file systems, old is copied to new (preserving file modes and symlinks) and then removed.",
+				"With -f, any existing file or directory at new is removed first.",
+				"Neither path may be inside the other.",
+			},
+		},
+		func(s *State, args ...string) (WaitFunc, error) {
+			force := false
+			args, err := ParseFlags(args, func(flag string) (bool, error) {
+				if flag != "-f" {
+					return false, nil
+				}
+				force = true
+				return true, nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			if len(args) != 2 {
+				return nil, ErrUsage
+			}
+			src, err := s.resolveLink(args[0])
+			if err != nil {
+				return nil, err
+			}
+			dst, err := s.resolveLink(args[1])
+			if err != nil {
+				return nil, err
+			}
+			if src != dst && (within(dst, src) || within(src, dst)) {
+				// Removing (or copying over) either path would destroy the other.
+				return nil, fmt.Errorf("cannot move %s to %s: one contains the other", src, dst)
+			}
+			if force && src != dst {
+				if _, err := os.Lstat(src); err != nil {
+					return nil, err
+				}
+				if err := removeAll(dst); err != nil {
+					return nil, err
+				}
+			}
+			err = os.Rename(src, dst)
+			if err != nil && isCrossDevice(err) {
+				return nil, moveByCopy(dst, src, s.checkWrite)
+			}
+			return nil, err
+		})
+}
+
+// moveByCopy moves src to dst by copying it and then removing src, for use
+// when they are on different file systems and cannot be renamed. As with a
+// rename, an existing file or empty directory at dst is replaced. If the copy
+// fails, whatever was copied is removed and src is left intact.
+func moveByCopy(dst, src string, check func(string) error) error {
+	if err := os.Remove(dst); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := copyEntry(dst, src, false, check); err != nil {
+		removeAll(dst)
+		return err
+	}
+	return removeAll(src)
+}
+
+// Program returns a new command that runs the named program, found from the
+// host process's PATH (not looked up in the script's PATH).
+func Program(name string, cancel func(*exec.Cmd) error, waitDelay time.Duration) Cmd {
+	var (
+		shortName    string
 		summary      string
 		lookPathOnce sync.Once
 		path         string
@@ -829,25 +2648,127 @@ func Program(name string, cancel func(*exec.Cmd) error, waitDelay time.Duration)
 			if pathErr != nil {
 				return nil, pathErr
 			}
-			return startCommand(s, shortName, path, args, cancel, waitDelay)
+			return startCommand(s, shortName, path, args, execOptions{}, cancel, waitDelay)
+		})
+}
+
+// Pwd writes the current working directory to the stdout buffer.
+func Pwd() Cmd {
+	return Command(
+		CmdUsage{
+			Summary:  "print the working directory",
+			ReadOnly: true,
+		},
+		func(s *State, args ...string) (WaitFunc, error) {
+			if len(args) != 0 {
+				return nil, ErrUsage
+			}
+			wd := s.Getwd()
+			return func(*State) (stdout, stderr string, err error) {
+				return wd + "\n", "", nil
+			}, nil
+		})
+}
+
+// Readlink prints the target of a symbolic link.
+func Readlink() Cmd {
+	return Command(
+		CmdUsage{
+			Summary: "print the target of a symlink",
+			Args:    "path",
+			Detail: []string{
+				"The target is written to stdout, with a trailing newline, exactly as it was given to the 'symlink' command (with slash separators). The command fails if path is not a symlink.",
+			},
+			ReadOnly: true,
+		},
+		func(s *State, args ...string) (WaitFunc, error) {
+			if len(args) != 1 {
+				return nil, ErrUsage
+			}
+			path, err := s.resolveLink(args[0])
+			if err != nil {
+				return nil, err
+			}
+			target, err := os.Readlink(path)
+			if err != nil {
+				return nil, err
+			}
+			return func(*State) (stdout, stderr string, err error) {
+				return filepath.ToSlash(target) + "\n", "", nil
+			}, nil
 		})
 }
 
 // Replace replaces all occurrences of a string in a file with another string.
+//
+// With the -regexp flag, each old string is instead a regular expression, and
+// the corresponding new string may refer to submatches as in
+// regexp.Regexp.Expand.
 func Replace() Cmd {
 	return Command(
 		CmdUsage{
 			Summary: "replace strings in a file",
-			Args:    "[old new]... file",
+			Args:    "[-regexp] [old new]... file",
 			Detail: []string{
 				"The 'old' and 'new' arguments are unquoted as if in quoted Go strings.",
+				"With -regexp, each 'old' argument is instead a Go regular expression (not unquoted), and 'new' may contain references to submatches such as $1 (in single quotes, to prevent expansion by the script).",
+				"The pairs are applied in order.",
+			},
+			RegexpArgs: func(rawArgs ...string) []int {
+				if len(rawArgs) == 0 || rawArgs[0] != "-regexp" {
+					return nil
+				}
+				start := 1
+				if len(rawArgs) > 1 && rawArgs[1] == "--" {
+					start = 2
+				}
+				var idx []int
+				for i := start; i < len(rawArgs)-1; i += 2 {
+					idx = append(idx, i)
+				}
+				return idx
 			},
 		},
 		func(s *State, args ...string) (WaitFunc, error) {
+			useRegexp := false
+			args, err := ParseFlags(args, func(flag string) (bool, error) {
+				if flag != "-regexp" {
+					return false, nil
+				}
+				useRegexp = true
+				return true, nil
+			})
+			if err != nil {
+				return nil, err
+			}
 			if len(args)%2 != 1 {
 				return nil, ErrUsage
 			}
 
+			file, err := s.ResolvePath(args[len(args)-1])
+			if err != nil {
+				return nil, err
+			}
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+
+			if useRegexp {
+				for i := 0; i < len(args)-1; i += 2 {
+					re, err := regexp.Compile(args[i])
+					if err != nil {
+						return nil, fmt.Errorf("invalid -regexp pattern: %v", err)
+					}
+					repl, err := strconv.Unquote(`"` + args[i+1] + `"`)
+					if err != nil {
+						return nil, err
+					}
+					data = re.ReplaceAll(data, []byte(repl))
+				}
+				return nil, os.WriteFile(file, data, 0666)
+			}
+
 			oldNew := make([]string, 0, len(args)-1)
 			for _, arg := range args[:len(args)-1] {
 				s, err := strconv.Unquote(`"` + arg + `"`)
@@ -858,18 +2779,117 @@ func Replace() Cmd {
 			}
 
 			r := strings.NewReplacer(oldNew...)
-			file := s.Path(args[len(args)-1])
+			replaced := r.Replace(string(data))
 
-			data, err := os.ReadFile(file)
+			return nil, os.WriteFile(file, []byte(replaced), 0666)
+		})
+}
+
+// Retry runs another command registered in the script's Engine, repeating it
+// until it succeeds or a limit on the number of attempts is reached.
+func Retry() Cmd {
+	return Command(
+		CmdUsage{
+			Summary: "run a command, retrying it until it succeeds",
+			Args:    "[-count=N] [-delay=D] cmd [args...]",
+			Detail: []string{
+				"Runs cmd up to N times (default 3), waiting for the Go time.Duration D (default 0) between attempts, until it succeeds.",
+				"The stdout and stderr buffers are set from the final attempt.",
+				"If every attempt fails, the error from the final attempt is reported. An attempt that fails because cmd was called with invalid arguments is not retried.",
+				"Each attempt is run like a command of the script itself: the Engine's Aliases, JSONLog, and BeforeCommand and AfterCommand hooks apply to it.",
+			},
+		},
+		func(s *State, args ...string) (WaitFunc, error) {
+			if s.engine == nil {
+				return nil, errors.New("no engine configured")
+			}
+
+			count := 3
+			var delay time.Duration
+			args, err := ParseFlags(args, func(flag string) (bool, error) {
+				switch {
+				case strings.HasPrefix(flag, "-count="):
+					n, err := strconv.Atoi(flag[len("-count="):])
+					if err != nil {
+						return false, fmt.Errorf("bad -count=: %v", err)
+					}
+					if n < 1 {
+						return false, fmt.Errorf("bad -count=: must be at least 1")
+					}
+					count = n
+				case strings.HasPrefix(flag, "-delay="):
+					d, err := time.ParseDuration(flag[len("-delay="):])
+					if err != nil {
+						return false, fmt.Errorf("bad -delay=: %v", err)
+					}
+					delay = d
+				default:
+					return false, nil
+				}
+				return true, nil
+			})
 			if err != nil {
 				return nil, err
 			}
-			replaced := r.Replace(string(data))
+			if len(args) == 0 {
+				return nil, ErrUsage
+			}
 
-			return nil, os.WriteFile(file, []byte(replaced), 0666)
+			e := s.engine
+			r := &command{name: args[0]}
+			if s.running != nil {
+				r.file, r.line = s.running.file, s.running.line
+				// The final attempt sets the stdout and stderr buffers, so it also
+				// makes any assignment of retry's output in retry's place.
+				r.assign, s.running.assign = s.running.assign, ""
+			}
+			for _, arg := range args[1:] {
+				r.rawArgs = append(r.rawArgs, []argFragment{{s: arg, quoted: true}})
+			}
+			if err := e.expandAlias(r); err != nil {
+				return nil, err
+			}
+			if e.Cmds[r.name] == nil {
+				return nil, fmt.Errorf("unknown command %q", r.name)
+			}
+
+			for attempt := 1; ; attempt++ {
+				a := *r
+				err = e.runSubcommand(s, &a)
+				if err == nil || errors.Is(err, ErrUsage) {
+					// Invalid arguments will not become valid by trying again.
+					return nil, err
+				}
+				if attempt == count {
+					s.Logf("[%s failed after %d attempts]\n", r.name, attempt)
+					return nil, err
+				}
+
+				s.Logf("[attempt %d: %v]\n", attempt, err)
+				if ctxErr := sleepContext(s, delay); ctxErr != nil {
+					return nil, ctxErr
+				}
+			}
 		})
 }
 
+// sleepContext waits for d to elapse or for the State's Context to be done,
+// returning the Context's error in the latter case.
+func sleepContext(s *State, d time.Duration) error {
+	ctx := s.Context()
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
 // Rm removes a file or directory.
 //
 // If a directory, Rm also recursively removes that directory's
@@ -878,17 +2898,48 @@ func Rm() Cmd {
 	return Command(
 		CmdUsage{
 			Summary: "remove a file or directory",
-			Args:    "path...",
+			Args:    "[-r] [-f] [-unsafe] path...",
 			Detail: []string{
-				"If the path is a directory, its contents are removed recursively.",
+				"If the path is a directory, its contents are removed recursively. A path that does not exist is not an error.",
+				"This matches 'rm -rf'; the -r and -f flags (or -rf) are accepted for familiarity and do not change the behavior.",
+				"Each path must be within the script's initial working directory ($WORK) and may not be that directory itself, unless -unsafe is given.",
 			},
 		},
 		func(s *State, args ...string) (WaitFunc, error) {
+			unsafe := false
+			args, err := ParseFlags(args, func(flag string) (bool, error) {
+				switch flag {
+				case "-r", "-f", "-rf", "-fr":
+				case "-unsafe":
+					unsafe = true
+				default:
+					return false, nil
+				}
+				return true, nil
+			})
+			if err != nil {
+				return nil, err
+			}
 			if len(args) < 1 {
 				return nil, ErrUsage
 			}
-			for _, arg := range args {
-				if err := removeAll(s.Path(arg)); err != nil {
+
+			// Check every path before removing any of them.
+			paths := make([]string, len(args))
+			for i, arg := range args {
+				paths[i], err = s.resolveLink(arg)
+				if err != nil {
+					return nil, err
+				}
+				if !unsafe {
+					rel, err := filepath.Rel(s.workdir, paths[i])
+					if err != nil || rel == "." || !filepath.IsLocal(rel) {
+						return nil, fmt.Errorf("%s is not within %s (use -unsafe to remove it anyway)", paths[i], s.workdir)
+					}
+				}
+			}
+			for _, path := range paths {
+				if err := removeAll(path); err != nil {
 					return nil, err
 				}
 			}
@@ -914,15 +2965,68 @@ func removeAll(dir string) error {
 	return robustio.RemoveAll(dir)
 }
 
-// Sleep sleeps for the given Go duration or until the script's context is
-// cancelled, whichever happens first.
+// Setenvfile sets environment variables from the KEY=VALUE lines of a file.
+func Setenvfile() Cmd {
+	return Command(
+		CmdUsage{
+			Summary: "set environment variables from a file",
+			Args:    "[-expand] file",
+			Detail: []string{
+				"Each line of the file must have the form KEY=VALUE. Blank lines and lines beginning with # are ignored, and spaces around KEY are trimmed. Variables are set in order, so later lines override earlier ones.",
+				"With -expand, ${var} and $var references in each VALUE are expanded using the environment as it stands when that line is reached.",
+			},
+			ReadOnly: true,
+		},
+		func(s *State, args ...string) (WaitFunc, error) {
+			expand := false
+			args, err := ParseFlags(args, func(flag string) (bool, error) {
+				if flag != "-expand" {
+					return false, nil
+				}
+				expand = true
+				return true, nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			if len(args) != 1 {
+				return nil, ErrUsage
+			}
+
+			data, err := s.ReadFile(args[0])
+			if err != nil {
+				return nil, err
+			}
+			for i, line := range strings.Split(string(data), "\n") {
+				line = strings.TrimSuffix(line, "\r")
+				if trimmed := strings.TrimSpace(line); trimmed == "" || strings.HasPrefix(trimmed, "#") {
+					continue
+				}
+				key, value, ok := strings.Cut(line, "=")
+				key = strings.TrimSpace(key)
+				if !ok || key == "" {
+					return nil, fmt.Errorf("%s:%d: malformed line %q: want KEY=VALUE", args[0], i+1, line)
+				}
+				if expand {
+					value = s.ExpandEnv(value, false)
+				}
+				if err := s.Setenv(key, value); err != nil {
+					return nil, err
+				}
+			}
+			return nil, nil
+		})
+}
+
+// Sleep sleeps for the given Go duration (or integer number of seconds) or
+// until the script's context is cancelled, whichever happens first.
 func Sleep() Cmd {
 	return Command(
 		CmdUsage{
 			Summary: "sleep for a specified duration",
 			Args:    "duration",
 			Detail: []string{
-				"The duration must be given as a Go time.Duration string.",
+				"The duration must be given as a Go time.Duration string, or as a bare integer number of seconds.",
 			},
 			Async: true,
 		},
@@ -931,9 +3035,14 @@ func Sleep() Cmd {
 				return nil, ErrUsage
 			}
 
-			d, err := time.ParseDuration(args[0])
-			if err != nil {
-				return nil, err
+			var d time.Duration
+			if n, err := strconv.Atoi(args[0]); err == nil {
+				d = time.Duration(n) * time.Second
+			} else {
+				d, err = time.ParseDuration(args[0])
+				if err != nil {
+					return nil, err
+				}
 			}
 
 			timer := time.NewTimer(d)
@@ -951,43 +3060,214 @@ func Sleep() Cmd {
 		})
 }
 
-// Stderr searches for a regular expression in the stderr buffer.
-func Stderr() Cmd {
+// Sort sorts the lines of a file, or of the stdout or stderr buffer.
+func Sort() Cmd {
 	return Command(
 		CmdUsage{
-			Summary: "find lines in the stderr buffer that match a pattern",
-			Args:    matchUsage + " file",
+			Summary: "sort the lines of a file",
+			Args:    "[-u] [-stdout] file",
 			Detail: []string{
-				"The command succeeds if at least one match (or the exact count, if given) is found.",
-				"The -q flag suppresses printing of matches.",
+				"Lines are sorted by byte value, independent of locale. With -u, only the first of each run of identical lines is kept.",
+				linesFileDetail,
 			},
-			RegexpArgs: firstNonFlag,
 		},
 		func(s *State, args ...string) (WaitFunc, error) {
-			return nil, match(s, args, s.Stderr(), "stderr")
+			var unique, toStdout bool
+			args, err := ParseFlags(args, func(flag string) (bool, error) {
+				switch flag {
+				case "-u":
+					unique = true
+				case "-stdout":
+					toStdout = true
+				default:
+					return false, nil
+				}
+				return true, nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			if len(args) != 1 {
+				return nil, ErrUsage
+			}
+			return filterLines(s, args[0], toStdout, func(lines []string) []string {
+				sort.Strings(lines)
+				if !unique {
+					return lines
+				}
+				out := lines[:0]
+				for i, line := range lines {
+					if i == 0 || line != lines[i-1] {
+						out = append(out, line)
+					}
+				}
+				return out
+			})
 		})
 }
 
-// Stdout searches for a regular expression in the stdout buffer.
-func Stdout() Cmd {
+// Stat stores metadata about a file in environment variables.
+func Stat() Cmd {
 	return Command(
 		CmdUsage{
-			Summary: "find lines in the stdout buffer that match a pattern",
-			Args:    matchUsage + " file",
+			Summary: "store file metadata in environment variables",
+			Args:    "[-size=VAR] [-mode=VAR] [-mtime=VAR] path",
 			Detail: []string{
-				"The command succeeds if at least one match (or the exact count, if given) is found.",
-				"The -q flag suppresses printing of matches.",
+				"At least one flag is required. -size stores the size of the file in bytes, -mode stores its permission bits as a four-digit octal number (like 0644), and -mtime stores its modification time as a Unix timestamp in seconds.",
+				"Symlinks are followed.",
 			},
-			RegexpArgs: firstNonFlag,
+			ReadOnly: true,
 		},
 		func(s *State, args ...string) (WaitFunc, error) {
-			return nil, match(s, args, s.Stdout(), "stdout")
+			var sizeVar, modeVar, mtimeVar string
+			args, err := ParseFlags(args, func(flag string) (bool, error) {
+				name, v, ok := strings.Cut(flag, "=")
+				if !ok || v == "" {
+					return false, ErrUsage
+				}
+				switch name {
+				case "-size":
+					sizeVar = v
+				case "-mode":
+					modeVar = v
+				case "-mtime":
+					mtimeVar = v
+				default:
+					return false, ErrUsage
+				}
+				return true, nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			if len(args) != 1 || (sizeVar == "" && modeVar == "" && mtimeVar == "") {
+				return nil, ErrUsage
+			}
+
+			info, err := s.Stat(args[0])
+			if err != nil {
+				return nil, err
+			}
+			if sizeVar != "" {
+				if err := s.Setenv(sizeVar, strconv.FormatInt(info.Size(), 10)); err != nil {
+					return nil, err
+				}
+			}
+			if modeVar != "" {
+				if err := s.Setenv(modeVar, fmt.Sprintf("%04o", info.Mode().Perm())); err != nil {
+					return nil, err
+				}
+			}
+			if mtimeVar != "" {
+				if err := s.Setenv(mtimeVar, strconv.FormatInt(info.ModTime().Unix(), 10)); err != nil {
+					return nil, err
+				}
+			}
+			return nil, nil
 		})
 }
 
-// Stop returns a sentinel error that causes script execution to halt
-// and s.Execute to return with a nil error.
-func Stop() Cmd {
+// Stderr searches for a regular expression in the stderr buffer.
+func Stderr() Cmd {
+	return Command(
+		CmdUsage{
+			Summary: "find lines in the stderr buffer that match a pattern",
+			Args:    matchUsage + " file",
+			Detail: []string{
+				"The command succeeds if at least one match (or the exact count, if given) is found.",
+				"Matches are counted without overlap, and -count=0 succeeds only if there is no match.",
+				"The -q flag suppresses printing of matches.",
+				"With -expand, environment variables in the pattern are expanded (with regular expression metacharacters in their values quoted), even if the pattern is quoted.",
+				"If there is no match, -A=N and -B=N print N lines of context after and before the line that contains the most literal text from the pattern, if any.",
+				"With -o, each match (or, with -group=N, the text of its Nth parenthesized subexpression) is written to the stdout buffer on a line of its own instead.",
+			},
+			RegexpArgs: firstNonFlag,
+			ReadOnly:   true,
+		},
+		func(s *State, args ...string) (WaitFunc, error) {
+			return match(s, args, s.Stderr(), "stderr")
+		})
+}
+
+// Stdin sets the standard input for the next program started by the script.
+func Stdin() Cmd {
+	return Command(
+		CmdUsage{
+			Summary: "set the standard input for the next program",
+			Args:    "file | -text string",
+			Detail: []string{
+				"The contents of file (which may be 'stdout' or 'stderr', for the corresponding buffer) are passed as the standard input of the next program started by 'exec' or a similar command, after which the input is cleared.",
+				"With -text, the string is unquoted as if in a quoted Go string and used as the input instead.",
+				"It is an error to set the input again before it has been used.",
+			},
+		},
+		func(s *State, args ...string) (WaitFunc, error) {
+			text := false
+			args, err := ParseFlags(args, func(flag string) (bool, error) {
+				if flag != "-text" || text {
+					return false, nil
+				}
+				text = true
+				return true, nil
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			var input string
+			switch {
+			case len(args) != 1:
+				return nil, ErrUsage
+			case text:
+				input, err = strconv.Unquote(`"` + args[0] + `"`)
+				if err != nil {
+					return nil, err
+				}
+			case args[0] == "stdout":
+				input = s.Stdout()
+			case args[0] == "stderr":
+				input = s.Stderr()
+			default:
+				data, err := s.ReadFile(args[0])
+				if err != nil {
+					return nil, err
+				}
+				input = string(data)
+			}
+
+			if s.hasStdin {
+				return nil, errors.New("standard input is already set and has not been used")
+			}
+			s.stdin, s.hasStdin = input, true
+			return nil, nil
+		})
+}
+
+// Stdout searches for a regular expression in the stdout buffer.
+func Stdout() Cmd {
+	return Command(
+		CmdUsage{
+			Summary: "find lines in the stdout buffer that match a pattern",
+			Args:    matchUsage + " file",
+			Detail: []string{
+				"The command succeeds if at least one match (or the exact count, if given) is found.",
+				"Matches are counted without overlap, and -count=0 succeeds only if there is no match.",
+				"The -q flag suppresses printing of matches.",
+				"With -expand, environment variables in the pattern are expanded (with regular expression metacharacters in their values quoted), even if the pattern is quoted.",
+				"If there is no match, -A=N and -B=N print N lines of context after and before the line that contains the most literal text from the pattern, if any.",
+				"With -o, each match (or, with -group=N, the text of its Nth parenthesized subexpression) is written to the stdout buffer on a line of its own instead.",
+			},
+			RegexpArgs: firstNonFlag,
+			ReadOnly:   true,
+		},
+		func(s *State, args ...string) (WaitFunc, error) {
+			return match(s, args, s.Stdout(), "stdout")
+		})
+}
+
+// Stop returns a sentinel error that causes script execution to halt
+// and s.Execute to return with a nil error.
+func Stop() Cmd {
 	return Command(
 		CmdUsage{
 			Summary: "stop execution of the script",
@@ -1021,6 +3301,234 @@ func (s stopError) Error() string {
 	return "stop: " + s.msg
 }
 
+// Tar writes the files in a directory to a txtar archive.
+func Tar() Cmd {
+	return Command(
+		CmdUsage{
+			Summary: "write a directory tree to a txtar archive",
+			Args:    "dir archive.txtar",
+			Detail: []string{
+				"Each regular file in dir and its subdirectories becomes a member of the archive, named by its slash-separated path relative to dir. Empty directories are not recorded.",
+				"Fails if dir contains anything other than files and directories, or a file that txtar cannot represent exactly: one that is not valid UTF-8, does not end in a newline, or contains a line that looks like a file marker.",
+			},
+		},
+		func(s *State, args ...string) (WaitFunc, error) {
+			if len(args) != 2 {
+				return nil, ErrUsage
+			}
+
+			root, err := s.ResolvePath(args[0])
+			if err != nil {
+				return nil, err
+			}
+			ar := new(txtar.Archive)
+			err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if d.IsDir() {
+					return nil
+				}
+				rel, err := filepath.Rel(root, path)
+				if err != nil {
+					return err
+				}
+				name := filepath.ToSlash(rel)
+				if !d.Type().IsRegular() {
+					return fmt.Errorf("%s: unsupported file type %v", name, d.Type())
+				}
+				data, err := os.ReadFile(path)
+				if err != nil {
+					return err
+				}
+				if err := checkTxtarData(data); err != nil {
+					return fmt.Errorf("%s: %v", name, err)
+				}
+				ar.Files = append(ar.Files, txtar.File{Name: name, Data: data})
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			return nil, s.WriteFile(args[1], txtar.Format(ar), 0666)
+		})
+}
+
+// checkTxtarData returns a non-nil error if data would not survive a round
+// trip through txtar.Format and txtar.Parse unchanged.
+func checkTxtarData(data []byte) error {
+	if !utf8.Valid(data) {
+		return errors.New("binary file cannot be stored in a txtar archive")
+	}
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		return errors.New("file without a trailing newline cannot be stored in a txtar archive")
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if len(line) >= len("--  --") && strings.HasPrefix(line, "-- ") && strings.HasSuffix(line, " --") && strings.TrimSpace(line[3:len(line)-3]) != "" {
+			return fmt.Errorf("line %q would be read as a txtar file marker", line)
+		}
+	}
+	return nil
+}
+
+// Tail truncates a file, or the stdout or stderr buffer, to its last lines.
+func Tail() Cmd {
+	return Command(
+		CmdUsage{
+			Summary: "keep only the last lines of a file",
+			Args:    "[-n=N] [-stdout] file",
+			Detail: []string{
+				"Replaces the contents of file with its last N lines (10 by default). If the file has fewer lines, it is left unchanged.",
+				linesFileDetail,
+			},
+		},
+		func(s *State, args ...string) (WaitFunc, error) {
+			n, toStdout, name, err := parseLineCount(args)
+			if err != nil {
+				return nil, err
+			}
+			return filterLines(s, name, toStdout, func(lines []string) []string {
+				if n < len(lines) {
+					lines = lines[len(lines)-n:]
+				}
+				return lines
+			})
+		})
+}
+
+// Touch creates files or updates their modification times.
+func Touch() Cmd {
+	return Command(
+		CmdUsage{
+			Summary: "create files or update their modification times",
+			Args:    "[-t=time | -r=reffile] file...",
+			Detail: []string{
+				"Creates each file as an empty file if it does not exist, then sets its access and modification times to the current time.",
+				"With -t, the times are instead set to the given time in RFC 3339 format (such as 2006-01-02T15:04:05Z). With -r, they are set to the modification time of reffile, so that a file can be given the same time as another or, after a later touch of the other, made older than it.",
+			},
+		},
+		func(s *State, args ...string) (WaitFunc, error) {
+			var (
+				t    time.Time
+				hasT bool
+			)
+			args, err := ParseFlags(args, func(flag string) (bool, error) {
+				switch {
+				case strings.HasPrefix(flag, "-t="):
+					var err error
+					t, err = time.Parse(time.RFC3339Nano, flag[len("-t="):])
+					if err != nil {
+						return false, fmt.Errorf("bad -t=: %v", err)
+					}
+				case strings.HasPrefix(flag, "-r="):
+					info, err := s.Stat(flag[len("-r="):])
+					if err != nil {
+						return false, err
+					}
+					t = info.ModTime()
+				default:
+					return false, nil
+				}
+				if hasT {
+					return false, ErrUsage
+				}
+				hasT = true
+				return true, nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			if len(args) == 0 {
+				return nil, ErrUsage
+			}
+			if !hasT {
+				t = time.Now()
+			}
+
+			for _, arg := range args {
+				path, err := s.ResolvePath(arg)
+				if err != nil {
+					return nil, err
+				}
+				if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+					if err := os.WriteFile(path, nil, 0666); err != nil {
+						return nil, err
+					}
+				}
+				if err := os.Chtimes(path, t, t); err != nil {
+					return nil, err
+				}
+			}
+			return nil, nil
+		})
+}
+
+// Trim removes white space, a prefix, or a suffix from a file, or from the
+// stdout or stderr buffer.
+func Trim() Cmd {
+	return Command(
+		CmdUsage{
+			Summary: "trim the contents of a file",
+			Args:    "[-lines] [-space] [-prefix=S] [-suffix=S] [-stdout] file",
+			Detail: []string{
+				"Replaces the contents of file with the result of removing leading and trailing white space (with -space), then a single leading S (with -prefix=S), then a single trailing S (with -suffix=S). At least one of these is required.",
+				"By default the trimming applies to the contents as a whole, ignoring a final newline, which is kept if anything remains. With -lines, it applies to each line separately.",
+				linesFileDetail,
+			},
+		},
+		func(s *State, args ...string) (WaitFunc, error) {
+			var (
+				lines, space, toStdout bool
+				prefix, suffix         string
+			)
+			args, err := ParseFlags(args, func(flag string) (bool, error) {
+				switch {
+				case flag == "-lines":
+					lines = true
+				case flag == "-space":
+					space = true
+				case flag == "-stdout":
+					toStdout = true
+				case strings.HasPrefix(flag, "-prefix="):
+					prefix = strings.TrimPrefix(flag, "-prefix=")
+				case strings.HasPrefix(flag, "-suffix="):
+					suffix = strings.TrimPrefix(flag, "-suffix=")
+				default:
+					return false, nil
+				}
+				return true, nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			if len(args) != 1 || (!space && prefix == "" && suffix == "") {
+				return nil, ErrUsage
+			}
+
+			trim := func(text string) string {
+				if space {
+					text = strings.TrimSpace(text)
+				}
+				return strings.TrimSuffix(strings.TrimPrefix(text, prefix), suffix)
+			}
+			if lines {
+				return filterLines(s, args[0], toStdout, func(lines []string) []string {
+					for i, line := range lines {
+						lines[i] = trim(line)
+					}
+					return lines
+				})
+			}
+			return filterText(s, args[0], toStdout, func(text string) string {
+				out := trim(strings.TrimSuffix(text, "\n"))
+				if out != "" && strings.HasSuffix(text, "\n") {
+					out += "\n"
+				}
+				return out
+			})
+		})
+}
+
 // Symlink creates a symbolic link.
 func Symlink() Cmd {
 	return Command(
@@ -1039,35 +3547,268 @@ func Symlink() Cmd {
 
 			// Note that the link target args[2] is not interpreted with s.Path:
 			// it will be interpreted relative to the directory file is in.
-			return nil, os.Symlink(filepath.FromSlash(args[2]), s.Path(args[0]))
+			path, err := s.resolveLink(args[0])
+			if err != nil {
+				return nil, err
+			}
+			return nil, os.Symlink(filepath.FromSlash(args[2]), path)
+		})
+}
+
+// Untar extracts the files in a txtar archive into a directory.
+func Untar() Cmd {
+	return Command(
+		CmdUsage{
+			Summary: "extract a txtar archive into a directory",
+			Args:    "archive.txtar dir",
+			Detail: []string{
+				"Writes each member of the archive to the path within dir given by its name, creating dir and any needed subdirectories. The archive's leading comment is ignored, and member names are not subject to environment expansion.",
+				"Fails without extracting anything if a member's name would place it outside of dir.",
+				"An archive embedded in the script's own archive cannot contain literal file markers; write them in another form (such as '== name ==') and restore them with 'replace' before extracting.",
+			},
+		},
+		func(s *State, args ...string) (WaitFunc, error) {
+			if len(args) != 2 {
+				return nil, ErrUsage
+			}
+
+			data, err := s.ReadFile(args[0])
+			if err != nil {
+				return nil, err
+			}
+			ar := txtar.Parse(data)
+			for _, f := range ar.Files {
+				if !filepath.IsLocal(filepath.FromSlash(f.Name)) {
+					return nil, fmt.Errorf("%s: member %q would be extracted outside of %s", args[0], f.Name, args[1])
+				}
+			}
+
+			dest, err := s.ResolvePath(args[1])
+			if err != nil {
+				return nil, err
+			}
+			if err := os.MkdirAll(dest, 0777); err != nil {
+				return nil, err
+			}
+			for _, f := range ar.Files {
+				path := filepath.Join(dest, filepath.FromSlash(f.Name))
+				if err := s.checkSandbox(path, true); err != nil {
+					return nil, err
+				}
+				if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+					return nil, err
+				}
+				if err := os.WriteFile(path, f.Data, 0666); err != nil {
+					return nil, err
+				}
+			}
+			return nil, nil
+		})
+}
+
+// Unzip extracts the contents of a zip archive.
+func Unzip() Cmd {
+	return Command(
+		CmdUsage{
+			Summary: "extract a zip archive",
+			Args:    "[-d=dir] archive.zip",
+			Detail: []string{
+				"Extracts the files and directories in the archive into dir (the current directory by default), creating it if needed, and preserving their permission bits.",
+				"Fails without extracting anything if the archive contains an entry that is neither a file nor a directory, or whose name would place it outside of dir.",
+			},
+		},
+		func(s *State, args ...string) (WaitFunc, error) {
+			dir := "."
+			args, err := ParseFlags(args, func(flag string) (bool, error) {
+				if !strings.HasPrefix(flag, "-d=") {
+					return false, nil
+				}
+				dir = strings.TrimPrefix(flag, "-d=")
+				return true, nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			if len(args) != 1 || dir == "" {
+				return nil, ErrUsage
+			}
+
+			zipfile, err := s.ResolvePath(args[0])
+			if err != nil {
+				return nil, err
+			}
+			zr, err := zip.OpenReader(zipfile)
+			if err != nil {
+				return nil, err
+			}
+			defer zr.Close()
+
+			// Check every entry before writing anything, so that a malicious or
+			// malformed archive does not leave partial output behind.
+			for _, f := range zr.File {
+				name := filepath.FromSlash(strings.TrimSuffix(f.Name, "/"))
+				if !filepath.IsLocal(name) || strings.Contains(f.Name, `\`) {
+					return nil, fmt.Errorf("%s: entry %q would be extracted outside of %s", args[0], f.Name, dir)
+				}
+				if mode := f.Mode(); !mode.IsRegular() && !mode.IsDir() {
+					return nil, fmt.Errorf("%s: entry %q has unsupported file type %v", args[0], f.Name, mode.Type())
+				}
+			}
+
+			dest, err := s.ResolvePath(dir)
+			if err != nil {
+				return nil, err
+			}
+			if err := os.MkdirAll(dest, 0777); err != nil {
+				return nil, err
+			}
+			// Directory permissions are set last, so that read-only directories
+			// can still be populated.
+			type dirMode struct {
+				path string
+				perm fs.FileMode
+			}
+			var dirs []dirMode
+			for _, f := range zr.File {
+				path := filepath.Join(dest, filepath.FromSlash(f.Name))
+				if err := s.checkSandbox(path, true); err != nil {
+					return nil, err
+				}
+				mode := f.Mode()
+				if mode.IsDir() {
+					if err := os.MkdirAll(path, 0777); err != nil {
+						return nil, err
+					}
+					dirs = append(dirs, dirMode{path, mode.Perm()})
+					continue
+				}
+				if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+					return nil, err
+				}
+				if err := unzipFile(f, path); err != nil {
+					return nil, err
+				}
+			}
+			for i := len(dirs) - 1; i >= 0; i-- {
+				if err := os.Chmod(dirs[i].path, dirs[i].perm); err != nil {
+					return nil, err
+				}
+			}
+			return nil, nil
 		})
 }
 
+// unzipFile writes the contents of f to a new file at path, with the
+// permission bits recorded in the archive.
+func unzipFile(f *zip.File, path string) (err error) {
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	perm := f.Mode().Perm()
+	w, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	// Apply the permissions explicitly, since OpenFile is subject to the umask
+	// and does not change the mode of an existing file.
+	return w.Chmod(perm)
+}
+
 // Wait waits for the completion of background commands.
 //
 // When Wait returns, the stdout and stderr buffers contain the concatenation of
 // the background commands' respective outputs in the order in which those
 // commands were started.
+//
+// The WaitFuncs of the background commands are called concurrently, each with
+// its own copy of the State. Anything they write to the log and any changes
+// they make to the environment are applied to the State in the order in which
+// the commands were started; any other changes to their copies are discarded.
 func Wait() Cmd {
 	return Command(
 		CmdUsage{
 			Summary: "wait for completion of background commands",
-			Args:    "",
+			Args:    "[-timeout=D] [-all | name...]",
 			Detail: []string{
-				"Waits for all background commands to complete.",
+				"Waits for all background commands to complete, or only for the named ones (started with -bg=name) if any names are given. 'wait -all' is equivalent to 'wait' with no names.",
+				"With -timeout, any of the commands still running after the Go time.Duration D are stopped as if by 'kill', and each of them is reported as an error.",
+				"The commands are waited for concurrently, and if more than one fails, all of their errors are reported.",
 				"The output (and any error) from each command is printed to the log in the order in which the commands were started.",
-				"After the call to 'wait', the script's stdout and stderr buffers contain the concatenation of the background commands' outputs.",
+				"After the call to 'wait', the script's stdout and stderr buffers contain the concatenation of the outputs of the commands waited for, in the order in which they were started (not the order in which they are named), including the output of commands that failed or were stopped.",
 			},
 		},
 		func(s *State, args ...string) (WaitFunc, error) {
-			if len(args) > 0 {
-				return nil, ErrUsage
+			var timeout time.Duration
+			all := false
+			args, err := ParseFlags(args, func(flag string) (bool, error) {
+				switch {
+				case strings.HasPrefix(flag, "-timeout="):
+					d, err := time.ParseDuration(flag[len("-timeout="):])
+					if err != nil {
+						return false, fmt.Errorf("bad -timeout=: %v", err)
+					}
+					if d <= 0 {
+						return false, errors.New("bad -timeout=: must be positive")
+					}
+					timeout = d
+				case flag == "-all":
+					all = true
+				default:
+					return false, nil
+				}
+				return true, nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			if all {
+				if len(args) > 0 {
+					return nil, ErrUsage
+				}
+				args = nil
+			}
+			want := make(map[*backgroundCmd]bool, len(args))
+			for _, name := range args {
+				bg, ok := s.named[name]
+				if !ok {
+					return nil, fmt.Errorf("no background command named %q", name)
+				}
+				want[bg] = true
+			}
+
+			var waiting, remaining []*backgroundCmd
+			for _, bg := range s.background {
+				if len(want) > 0 && !want[bg] {
+					remaining = append(remaining, bg)
+				} else {
+					waiting = append(waiting, bg)
+				}
 			}
+			before := make(map[string]string, len(s.envMap))
+			for k, v := range s.envMap {
+				before[k] = v
+			}
+			results := waitBackground(s, waiting, timeout)
 
 			var stdouts, stderrs []string
 			var errs []*CommandError
-			for _, bg := range s.background {
-				stdout, stderr, err := bg.wait(s)
+			for i, bg := range waiting {
+				r := results[i]
+				s.log.Write(r.log)
+				if err := s.mergeEnv(r.env, before); err != nil {
+					return nil, err
+				}
 
 				beforeArgs := ""
 				if len(bg.args) > 0 {
@@ -1075,25 +3816,37 @@ func Wait() Cmd {
 				}
 				s.Logf("[background] %s%s%s\n", bg.name, beforeArgs, quoteArgs(bg.args))
 
-				if stdout != "" {
-					s.Logf("[stdout]\n%s", stdout)
-					stdouts = append(stdouts, stdout)
+				if r.stdout != "" {
+					s.Logf("[stdout]\n%s", r.stdout)
+					stdouts = append(stdouts, r.stdout)
 				}
-				if stderr != "" {
-					s.Logf("[stderr]\n%s", stderr)
-					stderrs = append(stderrs, stderr)
+				if r.stderr != "" {
+					s.Logf("[stderr]\n%s", r.stderr)
+					stderrs = append(stderrs, r.stderr)
 				}
-				if err != nil {
-					s.Logf("[%v]\n", err)
+				if r.err != nil {
+					s.Logf("[%v]\n", r.err)
+				}
+				if bg.bgName != "" {
+					delete(s.named, bg.bgName)
+				}
+				if r.timedOut {
+					errs = append(errs, cmdError(bg.command, fmt.Errorf("still running after wait -timeout=%v; stopped", timeout)))
+					continue
+				}
+				if bg.killed {
+					// The script asked for the command to stop,
+					// so whatever status it ended with is expected.
+					continue
 				}
-				if cmdErr := checkStatus(bg.command, err); cmdErr != nil {
+				if cmdErr := checkStatus(bg.command, r.err); cmdErr != nil {
 					errs = append(errs, cmdErr.(*CommandError))
 				}
 			}
 
 			s.stdout = strings.Join(stdouts, "")
 			s.stderr = strings.Join(stderrs, "")
-			s.background = nil
+			s.background = remaining
 			if len(errs) > 0 {
 				return nil, waitError{errs: errs}
 			}
@@ -1101,6 +3854,231 @@ func Wait() Cmd {
 		})
 }
 
+// A waitResult records the outcome of a background command's WaitFunc.
+type waitResult struct {
+	stdout, stderr string
+	err            error
+	log            []byte            // written by the WaitFunc to its copy of the State's log
+	env            map[string]string // the environment of the copy after the WaitFunc returned
+	timedOut       bool              // the command was stopped because it outlasted the timeout
+}
+
+// waitBackground calls the WaitFuncs of cmds concurrently, each with a copy of
+// s, and returns their results in the same order as cmds.
+//
+// If timeout is positive, the commands that are still running after timeout
+// are canceled (and marked as timed out), and waitBackground continues to
+// wait for them to return.
+func waitBackground(s *State, cmds []*backgroundCmd, timeout time.Duration) []waitResult {
+	results := make([]waitResult, len(cmds))
+	done := make([]chan struct{}, len(cmds))
+	for i, bg := range cmds {
+		i, bg := i, bg
+		bs := s.copyForWait()
+		done[i] = make(chan struct{})
+		go func() {
+			defer close(done[i])
+			r := &results[i]
+			r.stdout, r.stderr, r.err = bg.wait(bs)
+			r.log = bs.log.Bytes()
+			r.env = bs.envMap
+		}()
+	}
+
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		for i := range cmds {
+			select {
+			case <-done[i]:
+				continue
+			case <-timer.C:
+			}
+			// The deadline has passed: stop every command that is still running.
+			for j := i; j < len(cmds); j++ {
+				select {
+				case <-done[j]:
+				default:
+					results[j].timedOut = true
+					cmds[j].cancel()
+				}
+			}
+			break
+		}
+	}
+	for _, c := range done {
+		<-c
+	}
+	return results
+}
+
+// WaitFor polls for the existence of a file, such as one written by a
+// background command to indicate that it is ready.
+func WaitFor() Cmd {
+	return Command(
+		CmdUsage{
+			Summary: "wait for a file to exist",
+			Args:    "[-timeout=D] path",
+			Detail: []string{
+				"Polls until the named file exists.",
+				"With -timeout, fails if the file does not exist after the Go time.Duration D. Otherwise, waits until the script's Context is done.",
+			},
+		},
+		func(s *State, args ...string) (WaitFunc, error) {
+			var timeout time.Duration
+			args, err := ParseFlags(args, func(flag string) (bool, error) {
+				if !strings.HasPrefix(flag, "-timeout=") {
+					return false, nil
+				}
+				d, err := time.ParseDuration(flag[len("-timeout="):])
+				if err != nil {
+					return false, fmt.Errorf("bad -timeout=: %v", err)
+				}
+				timeout = d
+				return true, nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			if len(args) != 1 {
+				return nil, ErrUsage
+			}
+
+			path, err := s.ResolvePath(args[0])
+			if err != nil {
+				return nil, err
+			}
+			var deadline <-chan time.Time
+			if timeout > 0 {
+				timer := time.NewTimer(timeout)
+				defer timer.Stop()
+				deadline = timer.C
+			}
+			ticker := time.NewTicker(10 * time.Millisecond)
+			defer ticker.Stop()
+
+			for {
+				if _, err := os.Stat(path); err == nil {
+					return nil, nil
+				}
+				select {
+				case <-s.Context().Done():
+					return nil, s.Context().Err()
+				case <-deadline:
+					return nil, fmt.Errorf("%s does not exist after %v", path, timeout)
+				case <-ticker.C:
+				}
+			}
+		})
+}
+
+// Wc counts the lines, words, or bytes in a file, or in the stdout or stderr
+// buffer.
+func Wc() Cmd {
+	return Command(
+		CmdUsage{
+			Summary: "count lines, words, or bytes",
+			Args:    "-l[=N] | -w[=N] | -c[=N] file",
+			Detail: []string{
+				"Counts the lines (-l), white-space-separated words (-w), or bytes (-c) in file. A final line without a trailing newline is counted as a line.",
+				"With =N, the command succeeds if the count is exactly N and fails otherwise, leaving the stdout buffer unchanged. Without it, the count is written to the stdout buffer.",
+				"The file may be 'stdout' or 'stderr' to count the contents of the script's stdout or stderr buffer.",
+			},
+			ReadOnly: true,
+		},
+		func(s *State, args ...string) (WaitFunc, error) {
+			var (
+				flag, want, unit string
+				hasWant          bool
+			)
+			args, err := ParseFlags(args, func(arg string) (bool, error) {
+				if unit != "" {
+					return false, ErrUsage
+				}
+				flag, want, hasWant = strings.Cut(arg, "=")
+				switch flag {
+				case "-l":
+					unit = "lines"
+				case "-w":
+					unit = "words"
+				case "-c":
+					unit = "bytes"
+				default:
+					return false, nil
+				}
+				return true, nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			if unit == "" || len(args) != 1 {
+				return nil, ErrUsage
+			}
+			wantN := 0
+			if hasWant {
+				if wantN, err = strconv.Atoi(want); err != nil || wantN < 0 {
+					return nil, fmt.Errorf("bad %s=: want a non-negative integer", flag)
+				}
+			}
+
+			name := args[0]
+			text, err := readFileOrBuffer(s, name)
+			if err != nil {
+				return nil, err
+			}
+
+			var n int
+			switch flag {
+			case "-l":
+				n = strings.Count(text, "\n")
+				if text != "" && !strings.HasSuffix(text, "\n") {
+					n++
+				}
+			case "-w":
+				n = len(strings.Fields(text))
+			case "-c":
+				n = len(text)
+			}
+
+			if hasWant {
+				if n != wantN {
+					return nil, fmt.Errorf("%s has %d %s, want %d", name, n, unit, wantN)
+				}
+				return nil, nil
+			}
+			return func(*State) (stdout, stderr string, err error) {
+				return strconv.Itoa(n) + "\n", "", nil
+			}, nil
+		})
+}
+
+// Write writes its argument to a file, such as a here document given inline
+// in the script.
+func Write() Cmd {
+	return Command(
+		CmdUsage{
+			Summary: "write content to a file",
+			Args:    "file content",
+			Detail: []string{
+				"Creates or truncates file, and any missing parent directories, and writes content to it.",
+				"Content is usually a here document (<<TERM, followed by lines of the script up to one consisting of TERM), which includes a newline at the end of each line.",
+			},
+		},
+		func(s *State, args ...string) (WaitFunc, error) {
+			if len(args) != 2 {
+				return nil, ErrUsage
+			}
+			path, err := s.ResolvePath(args[0])
+			if err != nil {
+				return nil, err
+			}
+			if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+				return nil, err
+			}
+			return nil, os.WriteFile(path, []byte(args[1]), 0666)
+		})
+}
+
 // A waitError wraps one or more errors returned by background commands.
 type waitError struct {
 	errs []*CommandError
@@ -1117,9 +4095,10 @@ func (w waitError) Error() string {
 	return b.String()
 }
 
-func (w waitError) Unwrap() error {
-	if len(w.errs) == 1 {
-		return w.errs[0]
+func (w waitError) Unwrap() []error {
+	errs := make([]error, len(w.errs))
+	for i, err := range w.errs {
+		errs[i] = err
 	}
-	return nil
+	return errs
 }
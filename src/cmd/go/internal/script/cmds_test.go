@@ -0,0 +1,213 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package script
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSleepCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := NewState(ctx, t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.CloseAndWait(new(strings.Builder))
+
+	wait, err := Sleep().Run(s, "1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+	_, _, err = wait(s)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("sleep 1m after cancel: %v; want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > 30*time.Second {
+		t.Errorf("sleep 1m returned %v after its context was canceled", elapsed)
+	}
+}
+
+func TestMoveByCopy(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) {
+		t.Helper()
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exists := func(name string) bool {
+		_, err := os.Lstat(filepath.Join(dir, name))
+		return err == nil
+	}
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	write("src/a.txt", "a")
+	write("src/sub/b.txt", "b")
+
+	// A copy that fails partway leaves no partial output, and src intact.
+	errCheck := errors.New("refused")
+	err := moveByCopy(dst, src, func(p string) error {
+		if filepath.Base(p) == "b.txt" {
+			return errCheck
+		}
+		return nil
+	})
+	if err != errCheck {
+		t.Fatalf("moveByCopy with failing check: %v; want %v", err, errCheck)
+	}
+	if exists("dst") {
+		t.Errorf("failed moveByCopy left partial output at dst")
+	}
+	if !exists("src/a.txt") || !exists("src/sub/b.txt") {
+		t.Errorf("failed moveByCopy removed src")
+	}
+
+	// A non-empty directory at dst is not replaced.
+	write("dst/keep.txt", "keep")
+	if err := moveByCopy(dst, src, nil); err == nil {
+		t.Errorf("moveByCopy replaced a non-empty directory")
+	}
+	if !exists("dst/keep.txt") || !exists("src/a.txt") {
+		t.Errorf("failed moveByCopy removed files")
+	}
+	if err := os.Remove(filepath.Join(dir, "dst", "keep.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Otherwise, src is copied to dst and removed.
+	if err := moveByCopy(dst, src, nil); err != nil {
+		t.Fatal(err)
+	}
+	if exists("src") {
+		t.Errorf("moveByCopy did not remove src")
+	}
+	data, err := os.ReadFile(filepath.Join(dst, "sub", "b.txt"))
+	if err != nil || string(data) != "b" {
+		t.Errorf("after moveByCopy, dst/sub/b.txt = %q, %v; want %q", data, err, "b")
+	}
+}
+
+func TestLimitedBuffer(t *testing.T) {
+	b := &limitedBuffer{limit: 5}
+	if n, err := b.Write([]byte("abc")); n != 3 || err != nil {
+		t.Fatalf("Write(abc) = %d, %v; want 3, nil", n, err)
+	}
+	if b.truncated {
+		t.Errorf("buffer truncated before reaching its limit")
+	}
+	if n, err := b.Write([]byte("defg")); n != 2 || err != errOutputLimit {
+		t.Errorf("Write(defg) = %d, %v; want 2, %v", n, err, errOutputLimit)
+	}
+	if !b.truncated {
+		t.Errorf("buffer not marked truncated after exceeding its limit")
+	}
+	if got := b.String(); got != "abcde" {
+		t.Errorf("String() = %q; want %q", got, "abcde")
+	}
+
+	// With no limit, every write succeeds.
+	var u limitedBuffer
+	for i := 0; i < 3; i++ {
+		if _, err := u.Write([]byte("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if u.truncated || len(u.String()) != 30 {
+		t.Errorf("unlimited buffer holds %q (truncated: %v)", u.String(), u.truncated)
+	}
+}
+
+func TestHexDiff(t *testing.T) {
+	a40 := strings.Repeat("a", 40)
+	z100 := strings.Repeat("z", 100)
+	rowA := strings.TrimSpace(strings.Repeat("61 ", 16))
+	rowZ := strings.TrimSpace(strings.Repeat("7a ", 16))
+	for _, tt := range []struct {
+		data1, data2 string
+		want         string
+	}{
+		{
+			// The last byte differs: the dump ends with the data.
+			a40, a40[:39] + "b",
+			"got and want differ at offset 39 (0x27); lengths 40 and 40\n" +
+				"offset    got                                              want\n" +
+				"00000000  " + rowA + "  " + rowA + "\n" +
+				"00000010  " + rowA + "  " + rowA + "\n" +
+				"00000020> 61 61 61 61 61 61 61 61                          61 61 61 61 61 61 61 62\n",
+		},
+		{
+			// One file is a prefix of the other: the difference is at the end of
+			// the shorter one.
+			"abc", "abcdef",
+			"got and want differ at offset 3 (0x3); lengths 3 and 6\n" +
+				"offset    got                                              want\n" +
+				"00000000> 61 62 63                                         61 62 63 64 65 66\n",
+		},
+		{
+			// Only the rows surrounding the difference are shown.
+			z100, z100[:80] + "Z" + z100[81:],
+			"got and want differ at offset 80 (0x50); lengths 100 and 100\n" +
+				"offset    got                                              want\n" +
+				"00000030  " + rowZ + "  " + rowZ + "\n" +
+				"00000040  " + rowZ + "  " + rowZ + "\n" +
+				"00000050> " + rowZ + "  5a" + rowZ[2:] + "\n" +
+				"00000060  7a 7a 7a 7a                                      7a 7a 7a 7a\n",
+		},
+	} {
+		if got := hexDiff("got", tt.data1, "want", tt.data2); got != tt.want {
+			t.Errorf("hexDiff(%q, %q):\n%s\nwant:\n%s", tt.data1, tt.data2, got, tt.want)
+		}
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	errBad := errors.New("bad flag")
+	for _, tt := range []struct {
+		args      []string
+		wantFlags []string
+		wantRest  []string
+		wantErr   error
+	}{
+		{args: nil, wantRest: nil},
+		{args: []string{"-a", "-b=1", "x", "-a"}, wantFlags: []string{"-a", "-b=1"}, wantRest: []string{"x", "-a"}},
+		{args: []string{"-a", "--", "-a", "--"}, wantFlags: []string{"-a"}, wantRest: []string{"-a", "--"}},
+		{args: []string{"--"}, wantRest: []string{}},
+		{args: []string{"-", "-a"}, wantRest: []string{"-", "-a"}},
+		{args: []string{"-a", "-unknown", "-a"}, wantFlags: []string{"-a"}, wantRest: []string{"-unknown", "-a"}},
+		{args: []string{"-a", "-bad"}, wantFlags: []string{"-a"}, wantErr: errBad},
+	} {
+		var flags []string
+		rest, err := ParseFlags(tt.args, func(flag string) (bool, error) {
+			switch {
+			case flag == "-a", strings.HasPrefix(flag, "-b="):
+				flags = append(flags, flag)
+				return true, nil
+			case flag == "-bad":
+				return false, errBad
+			}
+			return false, nil
+		})
+		if err != tt.wantErr {
+			t.Errorf("ParseFlags(%q): error %v; want %v", tt.args, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(flags, tt.wantFlags) || (err == nil && !reflect.DeepEqual(rest, tt.wantRest)) {
+			t.Errorf("ParseFlags(%q): parsed %q, returned %q; want %q, %q", tt.args, flags, rest, tt.wantFlags, tt.wantRest)
+		}
+	}
+}
@@ -6,9 +6,17 @@ package script
 
 import (
 	"cmd/go/internal/imports"
+	"errors"
 	"fmt"
+	"internal/goversion"
+	"io/fs"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 )
 
@@ -43,6 +51,14 @@ func DefaultConds() map[string]Cond {
 			return false, nil
 		})
 
+	conds["case-sensitive"] = &caseSensitiveCond{
+		usage: CondUsage{Summary: "the file system containing the current directory is case-sensitive"},
+	}
+
+	conds["ci"] = Condition(
+		"the script environment indicates a continuous integration system (CI, GITHUB_ACTIONS, GO_BUILDER_NAME, etc. is set)",
+		isCI)
+
 	conds["compiler"] = PrefixCondition(
 		"runtime.Compiler == <suffix>",
 		func(_ *State, suffix string) (bool, error) {
@@ -57,11 +73,195 @@ func DefaultConds() map[string]Cond {
 			}
 		})
 
-	conds["root"] = BoolCondition("os.Geteuid() == 0", os.Geteuid() == 0)
+	conds["eq"] = PrefixCondition(
+		"<suffix> has the form a:b, and a and b are equal after environment expansion",
+		func(s *State, suffix string) (bool, error) {
+			a, b, ok := strings.Cut(suffix, ":")
+			if !ok {
+				return false, fmt.Errorf("malformed suffix %q: want a:b", suffix)
+			}
+			return s.ExpandEnv(a, false) == s.ExpandEnv(b, false), nil
+		})
+
+	conds["exec"] = StateCachedCondition(
+		"<suffix> names an executable in the script's PATH",
+		func(s *State, suffix string) (bool, error) {
+			_, err := lookPath(s, s.ExpandEnv(suffix, false))
+			return err == nil, nil
+		})
+
+	conds["exists"] = PrefixCondition(
+		"<suffix> names an existing file or directory, after environment expansion",
+		func(s *State, suffix string) (bool, error) {
+			_, err := s.Stat(s.ExpandEnv(suffix, false))
+			return err == nil, nil
+		})
+
+	conds["file"] = PrefixCondition(
+		"<suffix> names an existing regular file, after environment expansion",
+		func(s *State, suffix string) (bool, error) {
+			info, err := s.Stat(s.ExpandEnv(suffix, false))
+			return err == nil && info.Mode().IsRegular(), nil
+		})
+
+	conds["file-contains"] = PrefixCondition(
+		"<suffix> has the form path:pattern, and the file at path exists and matches the regular expression pattern, after environment expansion (write \\: for a colon in path; since | separates alternative conditions, the pattern cannot use it, but may match it as \\x7c)",
+		func(s *State, suffix string) (bool, error) {
+			path, pattern, ok := cutUnescapedColon(suffix)
+			if !ok || path == "" {
+				return false, fmt.Errorf("malformed suffix %q: want path:pattern", suffix)
+			}
+			re, err := regexp.Compile(`(?m)` + s.ExpandEnv(pattern, true))
+			if err != nil {
+				return false, err
+			}
+			data, err := s.ReadFile(s.ExpandEnv(path, false))
+			if errors.Is(err, fs.ErrNotExist) {
+				return false, nil
+			} else if err != nil {
+				return false, err
+			}
+			return re.Match(data), nil
+		})
+
+	conds["goversion"] = PrefixCondition(
+		"the Go toolchain version is at least <suffix> (of the form goX.Y)",
+		func(_ *State, suffix string) (bool, error) {
+			major, minor, err := parseGoVersion(suffix)
+			if err != nil {
+				return false, err
+			}
+			if major != 1 {
+				return major < 1, nil
+			}
+			return minor <= goversion.Version, nil
+		})
+
+	conds["root"] = OnceCondition(
+		"os.Geteuid() == 0 (on Windows, the process has an elevated token)",
+		func() (bool, error) { return isRoot(), nil })
+
+	conds["version"] = VersionCondition(nil)
 
 	return conds
 }
 
+// ciEnvVars lists environment variables that are set by common continuous
+// integration systems.
+var ciEnvVars = []string{
+	"APPVEYOR",
+	"BUILDKITE",
+	"CIRCLECI",
+	"GITHUB_ACTIONS",
+	"GITLAB_CI",
+	"GO_BUILDER_NAME", // the Go project's own builders
+	"JENKINS_URL",
+	"TEAMCITY_VERSION",
+	"TF_BUILD", // Azure Pipelines
+	"TRAVIS",
+}
+
+// isCI reports whether the environment of s indicates that the script is
+// running under a continuous integration system. It consults the script's
+// environment rather than the process's, so that a test that controls the
+// environment also controls the result.
+func isCI(s *State) (bool, error) {
+	if v, ok := s.LookupEnv("CI"); ok && v != "" {
+		// Some systems set CI=false to disable CI-specific behavior.
+		return v != "false" && v != "0", nil
+	}
+	for _, key := range ciEnvVars {
+		if v, ok := s.LookupEnv(key); ok && v != "" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// parseGoVersion parses a version of the form "goX.Y".
+func parseGoVersion(v string) (major, minor int, err error) {
+	x, y, ok := strings.Cut(strings.TrimPrefix(v, "go"), ".")
+	if !strings.HasPrefix(v, "go") || !ok {
+		return 0, 0, fmt.Errorf("malformed Go version %q: want goX.Y", v)
+	}
+	major, err1 := strconv.Atoi(x)
+	minor, err2 := strconv.Atoi(y)
+	if err1 != nil || err2 != nil || major < 0 || minor < 0 {
+		return 0, 0, fmt.Errorf("malformed Go version %q: want goX.Y", v)
+	}
+	return major, minor, nil
+}
+
+// cutUnescapedColon slices s around the first colon that is not preceded by a
+// backslash, returning the text before and after it. Any escaped colons in
+// before are unescaped; after is returned unmodified.
+func cutUnescapedColon(s string) (before, after string, found bool) {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) && s[i+1] == ':' {
+				i++
+			}
+		case ':':
+			return strings.ReplaceAll(s[:i], `\:`, ":"), s[i+1:], true
+		}
+	}
+	return s, "", false
+}
+
+// A caseSensitiveCond reports whether the file system containing the State's
+// current directory is case-sensitive. The result is cached for each directory,
+// since different directories may reside on different file systems.
+type caseSensitiveCond struct {
+	m     sync.Map // directory → bool
+	usage CondUsage
+}
+
+func (c *caseSensitiveCond) Usage() *CondUsage { return &c.usage }
+
+func (c *caseSensitiveCond) Eval(s *State, suffix string) (bool, error) {
+	if suffix != "" {
+		return false, ErrUsage
+	}
+	dir := s.Getwd()
+	if v, ok := c.m.Load(dir); ok {
+		return v.(bool), nil
+	}
+	v, err := isCaseSensitive(dir)
+	if err != nil {
+		return false, err
+	}
+	c.m.Store(dir, v)
+	return v, nil
+}
+
+// isCaseSensitive reports whether the file system containing dir is
+// case-sensitive, by creating a file in a temporary subdirectory of dir and
+// attempting to read it back under a different case.
+func isCaseSensitive(dir string) (bool, error) {
+	tmpdir, err := os.MkdirTemp(dir, "case-sensitive")
+	if err != nil {
+		return false, fmt.Errorf("failed to create directory to determine case-sensitivity: %w", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	fcap := filepath.Join(tmpdir, "FILE")
+	if err := os.WriteFile(fcap, []byte{}, 0644); err != nil {
+		return false, fmt.Errorf("error writing file to determine case-sensitivity: %w", err)
+	}
+
+	flow := filepath.Join(tmpdir, "file")
+	_, err = os.ReadFile(flow)
+	switch {
+	case err == nil:
+		return false, nil
+	case os.IsNotExist(err):
+		return true, nil
+	default:
+		return false, fmt.Errorf("unexpected error reading file when determining case-sensitivity: %w", err)
+	}
+}
+
 // Condition returns a Cond with the given summary and evaluation function.
 func Condition(summary string, eval func(*State) (bool, error)) Cond {
 	return &funcCond{eval: eval, usage: CondUsage{Summary: summary}}
@@ -97,6 +297,44 @@ func (c *prefixCond) Eval(s *State, suffix string) (bool, error) {
 	return c.eval(s, suffix)
 }
 
+// ArgsCondition returns a Cond with the given summary and evaluation function,
+// which receives the condition's suffix split into arguments.
+//
+// The suffix is split at each colon, so that [name:a:b] passes the arguments
+// "a" and "b". Within an argument, \: denotes a literal colon and \\ a literal
+// backslash; any other backslash is kept as is. The suffix is not
+// environment-expanded, and an empty suffix is passed as a single empty
+// argument.
+//
+// As for any other condition, [!name:a:b] negates the result of the whole
+// condition.
+func ArgsCondition(summary string, eval func(*State, []string) (bool, error)) Cond {
+	return PrefixCondition(summary, func(s *State, suffix string) (bool, error) {
+		return eval(s, splitCondArgs(suffix))
+	})
+}
+
+// splitCondArgs splits a condition suffix into arguments for ArgsCondition.
+func splitCondArgs(suffix string) []string {
+	var (
+		args []string
+		arg  strings.Builder
+	)
+	for i := 0; i < len(suffix); i++ {
+		switch c := suffix[i]; {
+		case c == '\\' && i+1 < len(suffix) && (suffix[i+1] == ':' || suffix[i+1] == '\\'):
+			i++
+			arg.WriteByte(suffix[i])
+		case c == ':':
+			args = append(args, arg.String())
+			arg.Reset()
+		default:
+			arg.WriteByte(c)
+		}
+	}
+	return append(args, arg.String())
+}
+
 // BoolCondition returns a Cond with the given truth value and summary.
 // The Cond rejects the use of condition suffixes.
 func BoolCondition(summary string, v bool) Cond {
@@ -117,6 +355,90 @@ func (b *boolCond) Eval(s *State, suffix string) (bool, error) {
 	return b.v, nil
 }
 
+// And returns a Cond that is satisfied if all of conds are satisfied.
+// The conditions are evaluated in order, stopping at the first one that is
+// not satisfied or that returns an error.
+//
+// The Cond accepts a suffix only if every one of conds does, in which case
+// the suffix is passed to each of them.
+func And(conds ...Cond) Cond {
+	return newCombinedCond(conds, " and ", false)
+}
+
+// Or returns a Cond that is satisfied if any of conds is satisfied.
+// The conditions are evaluated in order, stopping at the first one that is
+// satisfied or that returns an error.
+//
+// The Cond accepts a suffix only if every one of conds does, in which case
+// the suffix is passed to each of them.
+func Or(conds ...Cond) Cond {
+	return newCombinedCond(conds, " or ", true)
+}
+
+type combinedCond struct {
+	conds []Cond
+	or    bool // satisfied if any of conds is satisfied, instead of all
+	usage CondUsage
+}
+
+func newCombinedCond(conds []Cond, sep string, or bool) *combinedCond {
+	c := &combinedCond{conds: conds, or: or}
+	summaries := make([]string, len(conds))
+	c.usage.Prefix = len(conds) > 0
+	c.usage.OptionalSuffix = len(conds) > 0
+	for i, cond := range conds {
+		usage := cond.Usage()
+		summaries[i] = "(" + usage.Summary + ")"
+		c.usage.Prefix = c.usage.Prefix && usage.Prefix
+		c.usage.OptionalSuffix = c.usage.OptionalSuffix && usage.OptionalSuffix
+	}
+	c.usage.Summary = strings.Join(summaries, sep)
+	return c
+}
+
+func (c *combinedCond) Usage() *CondUsage { return &c.usage }
+
+func (c *combinedCond) Eval(s *State, suffix string) (bool, error) {
+	if suffix != "" && !c.usage.Prefix {
+		return false, ErrUsage
+	}
+	for _, cond := range c.conds {
+		ok, err := cond.Eval(s, suffix)
+		if err != nil {
+			return false, err
+		}
+		if ok == c.or {
+			return ok, nil
+		}
+	}
+	return !c.or, nil
+}
+
+// Not returns a Cond that is satisfied if cond is not.
+// Errors from cond are returned unchanged.
+func Not(cond Cond) Cond {
+	usage := cond.Usage()
+	return &notCond{
+		cond:  cond,
+		usage: CondUsage{Summary: "not (" + usage.Summary + ")", Prefix: usage.Prefix, OptionalSuffix: usage.OptionalSuffix},
+	}
+}
+
+type notCond struct {
+	cond  Cond
+	usage CondUsage
+}
+
+func (c *notCond) Usage() *CondUsage { return &c.usage }
+
+func (c *notCond) Eval(s *State, suffix string) (bool, error) {
+	ok, err := c.cond.Eval(s, suffix)
+	if err != nil {
+		return false, err
+	}
+	return !ok, nil
+}
+
 // OnceCondition returns a Cond that calls eval the first time the condition is
 // evaluated. Future calls reuse the same result.
 //
@@ -203,3 +525,216 @@ func (c *cachedCond) Eval(_ *State, suffix string) (bool, error) {
 		}
 	}
 }
+
+// StateCachedCondition is like PrefixCondition, but caches the result of eval
+// for each suffix within each State, so that a condition that is expensive to
+// evaluate is computed only once per script for a given suffix.
+//
+// The cache for a State is discarded whenever the State's environment
+// changes, so eval may depend on the values of environment variables.
+// A Cond that keeps its own cache of values derived from the environment can
+// invalidate it in the same way by registering a function with
+// [State.OnSetenv].
+func StateCachedCondition(summary string, eval func(*State, string) (bool, error)) Cond {
+	return &stateCachedCond{eval: eval, usage: CondUsage{Summary: summary, Prefix: true}}
+}
+
+type stateCachedCond struct {
+	eval  func(*State, string) (bool, error)
+	usage CondUsage
+}
+
+func (c *stateCachedCond) Usage() *CondUsage { return &c.usage }
+
+func (c *stateCachedCond) Eval(s *State, suffix string) (bool, error) {
+	key := condCacheKey{cond: c, suffix: suffix}
+	if r, ok := s.condCache[key]; ok {
+		return r.v, r.err
+	}
+	v, err := c.eval(s, suffix)
+	if s.condCache == nil {
+		s.condCache = make(map[condCacheKey]condResult)
+	}
+	s.condCache[key] = condResult{v: v, err: err}
+	return v, err
+}
+
+// A condCacheKey identifies a cached StateCachedCondition result.
+type condCacheKey struct {
+	cond   *stateCachedCond
+	suffix string
+}
+
+type condResult struct {
+	v   bool
+	err error
+}
+
+// defaultVersionPattern matches the first dotted version number in the output
+// of a tool, such as "2.39.2" in "git version 2.39.2".
+var defaultVersionPattern = regexp.MustCompile(`[0-9]+(?:\.[0-9]+)+`)
+
+// VersionCondition returns a Cond that compares the version reported by a tool
+// against a constraint.
+//
+// The suffix has the form "tool:<op><version>", such as "git:>=2.20" or
+// "docker:<24", where op is one of ">=", ">", "<=", "<", "==", or "!=", and
+// version is a sequence of dot-separated integers. The tool is expanded and
+// found in the script's PATH as by the "exec" condition, then run with the
+// argument "--version". Its version is the leftmost match of pattern in the
+// tool's output (or, if pattern has a parenthesized subexpression, the text
+// matched by the first one), which must also be a sequence of dot-separated
+// integers; missing components compare as zero. If pattern is nil, it matches
+// the first sequence of at least two dot-separated integers.
+//
+// The condition is false if the tool cannot be found. A malformed suffix, or a
+// tool that fails or does not report a version, is an error.
+//
+// The version of each executable is determined only once, and the result is
+// shared by all scripts that evaluate the Cond.
+func VersionCondition(pattern *regexp.Regexp) Cond {
+	if pattern == nil {
+		pattern = defaultVersionPattern
+	}
+	return &versionCond{
+		pattern: pattern,
+		usage: CondUsage{
+			Summary: "<suffix> has the form tool:<op><version> (such as git:>=2.20), and 'tool --version' reports a version that satisfies it",
+			Prefix:  true,
+		},
+	}
+}
+
+type versionCond struct {
+	pattern *regexp.Regexp
+	usage   CondUsage
+
+	mu       sync.Mutex
+	versions map[string]versionResult // by absolute path of the tool
+}
+
+type versionResult struct {
+	v   []int
+	err error
+}
+
+func (c *versionCond) Usage() *CondUsage { return &c.usage }
+
+func (c *versionCond) Eval(s *State, suffix string) (bool, error) {
+	i := strings.LastIndex(suffix, ":")
+	if i < 0 {
+		return false, fmt.Errorf("malformed suffix %q: want tool:<op><version>", suffix)
+	}
+	tool, constraint := s.ExpandEnv(suffix[:i], false), suffix[i+1:]
+	var op string
+	for _, o := range []string{">=", "<=", "==", "!=", ">", "<"} {
+		if strings.HasPrefix(constraint, o) {
+			op = o
+			break
+		}
+	}
+	if op == "" {
+		return false, fmt.Errorf("malformed constraint %q: want <op><version>, where op is one of >=, >, <=, <, ==, or !=", constraint)
+	}
+	want, err := parseDottedVersion(constraint[len(op):])
+	if err != nil {
+		return false, fmt.Errorf("malformed constraint %q: %v", constraint, err)
+	}
+
+	path, err := lookPath(s, tool)
+	if err != nil {
+		return false, nil
+	}
+	have, err := c.version(s, path)
+	if err != nil {
+		return false, err
+	}
+
+	cmp := compareDottedVersions(have, want)
+	switch op {
+	case ">=":
+		return cmp >= 0, nil
+	case ">":
+		return cmp > 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case "<":
+		return cmp < 0, nil
+	case "==":
+		return cmp == 0, nil
+	default: // "!="
+		return cmp != 0, nil
+	}
+}
+
+// version returns the version reported by the tool at path, running it only
+// if its version is not already known.
+func (c *versionCond) version(s *State, path string) ([]int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if r, ok := c.versions[path]; ok {
+		return r.v, r.err
+	}
+
+	var r versionResult
+	cmd := exec.CommandContext(s.Context(), path, "--version")
+	cmd.Dir = s.Getwd()
+	cmd.Env = s.Environ()
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		r.err = fmt.Errorf("%s --version: %v\n%s", path, err, out)
+	} else if m := c.pattern.FindSubmatch(out); m == nil {
+		r.err = fmt.Errorf("%s --version: no version matching %#q in output:\n%s", path, c.pattern, out)
+	} else {
+		text := m[0]
+		if len(m) > 1 {
+			text = m[1]
+		}
+		if r.v, err = parseDottedVersion(string(text)); err != nil {
+			r.err = fmt.Errorf("%s --version: %v", path, err)
+		}
+	}
+	if s.Context().Err() != nil {
+		// Don't cache the result of a command that was interrupted.
+		return r.v, r.err
+	}
+	if c.versions == nil {
+		c.versions = make(map[string]versionResult)
+	}
+	c.versions[path] = r
+	return r.v, r.err
+}
+
+// parseDottedVersion parses a version of the form "1", "1.2", "1.2.3", etc.
+func parseDottedVersion(v string) ([]int, error) {
+	var vs []int
+	for _, f := range strings.Split(v, ".") {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 0 || strings.HasPrefix(f, "+") {
+			return nil, fmt.Errorf("malformed version %q", v)
+		}
+		vs = append(vs, n)
+	}
+	return vs, nil
+}
+
+// compareDottedVersions returns -1, 0, or +1 as a is less than, equal to, or
+// greater than b, treating missing components as zero.
+func compareDottedVersions(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return +1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,14 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+
+package script
+
+import "os"
+
+// isRoot reports whether the process is running with an effective user ID of 0.
+func isRoot() bool {
+	return os.Geteuid() == 0
+}
@@ -0,0 +1,183 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package script
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCombinedConds(t *testing.T) {
+	s, err := NewState(context.Background(), t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.CloseAndWait(new(strings.Builder))
+
+	// Each condition records its name when evaluated, so that short-circuiting
+	// can be observed.
+	var calls string
+	errCond := errors.New("condition failed")
+	cond := func(name string) Cond {
+		return Condition(name, func(*State) (bool, error) {
+			calls += name
+			switch name {
+			case "T":
+				return true, nil
+			case "F":
+				return false, nil
+			}
+			return false, errCond
+		})
+	}
+	T, F, E := cond("T"), cond("F"), cond("E")
+
+	for _, tt := range []struct {
+		desc      string
+		cond      Cond
+		want      bool
+		wantErr   error
+		wantCalls string
+	}{
+		{"And()", And(), true, nil, ""},
+		{"And(T, T)", And(T, T), true, nil, "TT"},
+		{"And(T, F, T)", And(T, F, T), false, nil, "TF"},
+		{"And(T, E, F)", And(T, E, F), false, errCond, "TE"},
+		{"And(F, E)", And(F, E), false, nil, "F"},
+		{"Or()", Or(), false, nil, ""},
+		{"Or(F, F)", Or(F, F), false, nil, "FF"},
+		{"Or(F, T, F)", Or(F, T, F), true, nil, "FT"},
+		{"Or(F, E, T)", Or(F, E, T), false, errCond, "FE"},
+		{"Or(T, E)", Or(T, E), true, nil, "T"},
+		{"Not(T)", Not(T), false, nil, "T"},
+		{"Not(F)", Not(F), true, nil, "F"},
+		{"Not(E)", Not(E), false, errCond, "E"},
+		{"Not(And(T, Or(F, T)))", Not(And(T, Or(F, T))), false, nil, "TFT"},
+	} {
+		calls = ""
+		got, err := tt.cond.Eval(s, "")
+		if got != tt.want || err != tt.wantErr || calls != tt.wantCalls {
+			t.Errorf("%s = %v, %v (evaluated %q); want %v, %v (evaluated %q)", tt.desc, got, err, calls, tt.want, tt.wantErr, tt.wantCalls)
+		}
+	}
+
+	if got, want := And(T, Or(F, Not(T))).Usage().Summary, "(T) and ((F) or (not (T)))"; got != want {
+		t.Errorf("summary = %q; want %q", got, want)
+	}
+
+	// A suffix is passed to each condition only if all of them accept one.
+	var suffixes []string
+	prefix := PrefixCondition("P", func(_ *State, suffix string) (bool, error) {
+		suffixes = append(suffixes, suffix)
+		return true, nil
+	})
+	if ok, err := And(prefix, prefix).Eval(s, "x"); !ok || err != nil {
+		t.Errorf("And(prefix, prefix) with suffix = %v, %v; want true, nil", ok, err)
+	}
+	if !reflect.DeepEqual(suffixes, []string{"x", "x"}) {
+		t.Errorf("suffixes passed: %q; want [x x]", suffixes)
+	}
+	if _, err := Or(prefix, T).Eval(s, "x"); !errors.Is(err, ErrUsage) {
+		t.Errorf("Or(prefix, T) with suffix: %v; want %v", err, ErrUsage)
+	}
+}
+
+func TestSplitCondArgs(t *testing.T) {
+	for _, tt := range []struct {
+		suffix string
+		want   []string
+	}{
+		{"", []string{""}},
+		{"a", []string{"a"}},
+		{"a:b", []string{"a", "b"}},
+		{"a::b:", []string{"a", "", "b", ""}},
+		{`a\:b:c`, []string{"a:b", "c"}},
+		{`a\\:b`, []string{`a\`, "b"}},
+		{`C:\dir\file`, []string{"C", `\dir\file`}},
+		{`a\`, []string{`a\`}},
+	} {
+		if got := splitCondArgs(tt.suffix); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitCondArgs(%#q) = %q; want %q", tt.suffix, got, tt.want)
+		}
+	}
+}
+
+func TestArgsCondition(t *testing.T) {
+	e := NewEngine()
+	e.Conds["kv"] = ArgsCondition("env var <arg 0> has value <arg 1>", func(s *State, args []string) (bool, error) {
+		if len(args) != 2 {
+			return false, ErrUsage
+		}
+		v, _ := s.LookupEnv(args[0])
+		return v == args[1], nil
+	})
+
+	s, err := NewState(context.Background(), t.TempDir(), []string{"K=a:b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.CloseAndWait(new(strings.Builder))
+
+	script := `
+[kv:K:a\:b] env ESCAPED=1
+[kv:K:a] env PARTIAL=1
+[!kv:K:a] echo negated
+`
+	log := new(strings.Builder)
+	if err := e.Execute(s, "test.txt", bufio.NewReader(strings.NewReader(script)), log); err != nil {
+		t.Fatalf("%v\n%s", err, log)
+	}
+	if _, ok := s.LookupEnv("ESCAPED"); !ok {
+		t.Errorf("[kv:K:a\\:b] did not match K=a:b\n%s", log)
+	}
+	if _, ok := s.LookupEnv("PARTIAL"); ok {
+		t.Errorf("[kv:K:a] unexpectedly matched K=a:b\n%s", log)
+	}
+	if s.Stdout() != "negated\n" {
+		t.Errorf("stdout = %q; want %q\n%s", s.Stdout(), "negated\n", log)
+	}
+
+	err = e.Execute(s, "test.txt", bufio.NewReader(strings.NewReader("[kv:K] echo x\n")), log)
+	if err == nil {
+		t.Errorf("condition with the wrong number of arguments unexpectedly succeeded")
+	}
+}
+
+func TestVersionConditionErrors(t *testing.T) {
+	e := NewEngine()
+	s, err := NewState(context.Background(), t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.CloseAndWait(new(strings.Builder))
+
+	// Malformed constraints are reported even if the tool does not exist.
+	for _, cond := range []string{
+		"version:no-such-tool",
+		"version:no-such-tool:2.0",
+		"version:no-such-tool:>=",
+		"version:no-such-tool:>=v2",
+		"version:no-such-tool:>=2..0",
+		"version:no-such-tool:>=-1",
+	} {
+		script := "[" + cond + "] echo x\n"
+		log := new(strings.Builder)
+		if err := e.Execute(s, "test.txt", bufio.NewReader(strings.NewReader(script)), log); err == nil {
+			t.Errorf("[%s] unexpectedly succeeded", cond)
+		}
+	}
+
+	log := new(strings.Builder)
+	if err := e.Execute(s, "test.txt", bufio.NewReader(strings.NewReader("[version:no-such-tool:>=2] env FOUND=1\n")), log); err != nil {
+		t.Errorf("[version:no-such-tool:>=2]: %v", err)
+	}
+	if _, ok := s.LookupEnv("FOUND"); ok {
+		t.Errorf("[version:no-such-tool:>=2] is unexpectedly true")
+	}
+}
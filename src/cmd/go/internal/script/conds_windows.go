@@ -0,0 +1,25 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package script
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// isRoot reports whether the process is running with an elevated token, which
+// is the closest Windows equivalent to running as root. The check is
+// best-effort: if the token cannot be queried, isRoot reports false.
+func isRoot() bool {
+	token, err := syscall.OpenCurrentProcessToken()
+	if err != nil {
+		return false
+	}
+	defer token.Close()
+
+	var elevated, n uint32
+	err = syscall.GetTokenInformation(token, syscall.TokenElevation, (*byte)(unsafe.Pointer(&elevated)), uint32(unsafe.Sizeof(elevated)), &n)
+	return err == nil && elevated != 0
+}
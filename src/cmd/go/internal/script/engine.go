@@ -21,7 +21,10 @@
 // end-of-line comment. Additional variables named ':' and '/' are expanded
 // within script arguments (expanding to the value of os.PathListSeparator and
 // os.PathSeparator respectively) but are not inherited in subprocess
-// environments.
+// environments. As in a POSIX shell, ${var:-word} expands to word if var is
+// unset or empty, ${var:+word} expands to word only if var is set and
+// non-empty, and word may itself refer to variables. $$ expands to a single
+// literal $.
 //
 // Adding single quotes around text keeps spaces in that text from being treated
 // as word separators and also disables environment variable expansion.
@@ -30,8 +33,22 @@
 //
 //	'Don''t communicate by sharing memory.'
 //
+// An argument that begins with a double quote is also kept together up to the
+// matching double quote, but environment variables within it are still
+// expanded. Within double quotes, a backslash followed by ", \, or $ denotes
+// that character literally, and \n and \t denote a newline and a tab; any
+// other backslash is kept as is. A double quote in the middle of an
+// argument has no special meaning.
+//
+// The built-in commands that accept flags stop parsing them at an argument
+// "--", so that a file name or pattern that begins with "-" can follow it,
+// as in 'rm -- -weird-name'.
+//
 // A line beginning with # is a comment and conventionally explains what is
 // being done or tested at the start of a new section of the script.
+// A line beginning with '## NOTE:' is instead an annotation: the rest of the
+// line is copied into the section's log (and JSON log, if any) as a labeled
+// checkpoint.
 //
 // Commands are executed one at a time, and errors are checked for each command;
 // if any command fails unexpectedly, no subsequent commands in the script are
@@ -46,16 +63,78 @@
 // A condition can be negated: [!root] means to run the rest of the line only if
 // the user is not root. Multiple conditions may be given for a single command,
 // for example, '[linux] [amd64] skip'. The command will run if all conditions
-// are satisfied.
+// are satisfied. The brackets may also be written without spaces between
+// them, as in '[linux][!race] skip'.
+//
+// Alternative conditions may be separated by | within a single pair of
+// brackets: [GOOS:linux|GOOS:darwin] is satisfied if either condition is. A
+// negation applies to the entire group, so [!a|b] means "neither a nor b";
+// individual alternatives cannot be negated.
+//
+// The lines between 'repeat N' and a matching 'end' line are executed N times,
+// with the variable ITER set to the index (starting at 0) of each iteration.
+// Similarly, the lines between 'foreach var in values...' and 'end' are
+// executed once for each value, with the variable var set to that value.
+// Blocks may be nested, and may be guarded by conditions (but not by other
+// prefixes). Conditions and variables within a block are evaluated anew on
+// each iteration. After the block, the variable is restored to its previous
+// value.
+//
+// The line 'include file' executes the lines of the named file (often a file
+// extracted from the script's archive) as if they appeared in place of the
+// include line. The file is resolved relative to the current directory, like
+// the arguments of other commands, and may itself include other files, but not
+// recursively. Changes it makes to the environment and current directory
+// persist after the include. Like 'repeat', an include line may be guarded by
+// conditions but not by other prefixes.
+//
+// The command prefix [timeout=DURATION] limits the execution of the command on
+// the rest of the line to the given Go time.Duration, after which the
+// command's Context is canceled and the command fails. It may be combined with
+// condition prefixes. For a background command, the limit also covers the
+// time until the command is reaped by 'wait'.
+//
+// If the last argument of a command is of the form <<TERM, the lines that
+// follow it, up to a line consisting of exactly TERM, are instead passed to the
+// command as its last argument (a "here document"), with each line terminated
+// by a newline. Environment variables in those lines are expanded unless some
+// part of TERM is quoted, as in <<'EOF'. The 'write' command stores such an
+// argument in a file:
+//
+//	write hello.go <<EOF
+//	package main
+//	EOF
+//
+// A command name may be preceded by 'var=', as in 'VERSION=exec go version',
+// to set the variable var to the command's standard output (with leading and
+// trailing white space removed) if the command succeeds. If the command fails,
+// the script stops unless the failure was expected (with a ! or ? prefix), in
+// which case the variable is left unchanged. Output cannot be assigned from a
+// background command.
+//
+// A trailing & runs a command in the background: its output and error are
+// collected, and checked against any ! or ? prefix, by a later 'wait'. An
+// asynchronous command (such as 'exec' or 'sleep') keeps running concurrently
+// with the rest of the script. Any other command runs to completion before the
+// next line, but its results are likewise reported only by 'wait'.
+//
+// An asynchronous command may also be given a name by passing
+// -bg=name as its first argument, which runs it in the background like a
+// trailing &. A named background command can be stopped with 'kill name' and
+// reaped individually with 'wait name'.
 package script
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -67,16 +146,126 @@ type Engine struct {
 	Cmds  map[string]Cmd
 	Conds map[string]Cond
 
+	// Aliases maps short command names to the text of the commands they stand
+	// for. If the name of a command in a script is a key in Aliases, Execute
+	// replaces the name with the expansion before running the command, so that
+	// if Aliases["gobuild"] is "exec go build", the line 'gobuild ./...' runs
+	// 'exec go build ./...'. The expansion is split into arguments and quoted
+	// like the rest of a script line, but it cannot contain prefixes such as
+	// conditions or '!'. If an expansion begins with another alias, that alias
+	// is expanded in turn, but an alias is never expanded again within its own
+	// expansion.
+	Aliases map[string]string
+
 	// If Quiet is true, Execute deletes log prints from the previous
 	// section when starting a new section.
 	Quiet bool
+
+	// If DryRun is true, Execute parses every line and evaluates conditions as
+	// usual, but runs only commands whose usage reports them as ReadOnly. Other
+	// commands are logged as skipped and treated as if they had the expected
+	// outcome.
+	DryRun bool
+
+	// If JSONLog is non-nil, Execute writes a JSON-encoded CommandRecord to it
+	// for each command line in the script, one per line, in addition to the
+	// text written to the log passed to Execute. Each record is written with a
+	// single call to Write.
+	JSONLog io.Writer
+
+	// If UpdateGolden is true, a 'cmp' command (or one that reports an error
+	// from NewMismatchError) that is expected to succeed but finds a
+	// difference instead succeeds if its second file was extracted from an
+	// archive by State.ExtractFiles: the contents of the first file replace
+	// those of the second, both on disk and in the archive. The names of the
+	// archive files that were rewritten are reported by State.UpdatedFiles.
+	UpdateGolden bool
+
+	// If MaxOutputBytes is positive, a program run by 'exec' (or by a command
+	// created with Program) may write at most that many bytes to each of its
+	// stdout and stderr. The output beyond the limit is discarded, and the
+	// command fails with an error reporting the truncation. Output that is
+	// redirected to a file (as with 'exec -stdout=file') is not limited.
+	// NewEngine sets MaxOutputBytes to DefaultMaxOutputBytes.
+	MaxOutputBytes int
+
+	// If MaxDiffLines is positive, the diffs reported by 'cmp', 'cmpenv', and
+	// 'diff' are truncated to their first MaxDiffLines lines, followed by a line
+	// counting the differences that were omitted. The -max-diff-lines flag of
+	// those commands overrides it. NewEngine sets MaxDiffLines to
+	// DefaultMaxDiffLines.
+	MaxDiffLines int
+
+	// If Timeout is positive, it limits the time that each call to Execute may
+	// run: Execute replaces the State's Context with one that expires after
+	// Timeout, so that the running command (and any background commands) are
+	// canceled when it does, and then fails with an error that identifies that
+	// command. The original Context is restored, and the replacement canceled,
+	// when Execute returns.
+	Timeout time.Duration
+
+	// If Sandbox is true, the commands run by Execute may only access files
+	// within the State's initial working directory: any path that resolves to a
+	// location outside of it, after evaluating symlinks, is an error, and so is
+	// changing to a directory outside of it. Commands that run programs, such as
+	// 'exec', are also rejected unless SandboxExec is set; the programs
+	// themselves are not confined. Commands other than the ones in DefaultCmds
+	// must resolve their paths with State.ResolvePath to respect the sandbox.
+	Sandbox bool
+
+	// If SandboxExec is true, a Sandbox does not prevent commands from running
+	// programs.
+	SandboxExec bool
+
+	// If BeforeCommand is non-nil, Execute calls it before running each command
+	// (other than block constructs such as 'repeat'), and also for each command
+	// that is not run because its conditions are not satisfied.
+	BeforeCommand func(s *State, cmd *CommandInfo)
+
+	// If AfterCommand is non-nil, Execute calls it after each command for which
+	// it called BeforeCommand, with the error (if any) that the command caused
+	// the script to report and the time spent running the command.
+	// A 'stop' command is reported with a nil error.
+	AfterCommand func(s *State, cmd *CommandInfo, err error, elapsed time.Duration)
+}
+
+// A CommandInfo describes a command for the BeforeCommand and AfterCommand
+// hooks of an Engine.
+type CommandInfo struct {
+	File    string
+	Line    int
+	Name    string
+	Args    []string // arguments after environment expansion; nil if Skipped
+	Skipped bool     // the command was not run because its conditions were not satisfied
 }
 
+// A CommandRecord describes the execution of a single command line,
+// as written to an Engine's JSONLog.
+type CommandRecord struct {
+	File     string  `json:"file"`
+	Line     int     `json:"line"`
+	Command  string  `json:"command"`         // the raw text of the line
+	CondsMet bool    `json:"conds_met"`       // whether the line's conditions were satisfied
+	Elapsed  float64 `json:"elapsed"`         // time spent running the command, in seconds
+	Error    string  `json:"error,omitempty"` // the error that stopped the script, if any
+	Note     string  `json:"note,omitempty"`  // for a '## NOTE:' line, the text of the note
+}
+
+// DefaultMaxOutputBytes is the default value of Engine.MaxOutputBytes for an
+// Engine returned by NewEngine.
+const DefaultMaxOutputBytes = 64 << 20
+
+// DefaultMaxDiffLines is the default value of Engine.MaxDiffLines for an
+// Engine returned by NewEngine.
+const DefaultMaxDiffLines = 1000
+
 // NewEngine returns an Engine configured with a basic set of commands and conditions.
 func NewEngine() *Engine {
 	return &Engine{
-		Cmds:  DefaultCmds(),
-		Conds: DefaultConds(),
+		Cmds:           DefaultCmds(),
+		Conds:          DefaultConds(),
+		MaxOutputBytes: DefaultMaxOutputBytes,
+		MaxDiffLines:   DefaultMaxDiffLines,
 	}
 }
 
@@ -109,10 +298,17 @@ type CmdUsage struct {
 	Args    string   // a brief synopsis of the command's arguments (only)
 	Detail  []string // zero or more sentences in the style of the Description section of a Unix 'man' page
 
-	// If Async is true, the Cmd is meaningful to run in the background, and its
-	// Run method must return either a non-nil WaitFunc or a non-nil error.
+	// If Async is true, the Cmd continues to run after its Run method returns,
+	// so that running it in the background lets it proceed concurrently with
+	// the rest of the script, and its Run method must return either a non-nil
+	// WaitFunc or a non-nil error. Other commands may also be run in the
+	// background, but they complete before Run returns.
 	Async bool
 
+	// If ReadOnly is true, the Cmd does not modify the file system or start
+	// processes, and is run even when the Engine is in DryRun mode.
+	ReadOnly bool
+
 	// RegexpArgs reports which arguments, if any, should be treated as regular
 	// expressions. It takes as input the raw, unexpanded arguments and returns
 	// the list of argument indices that will be interpreted as regular
@@ -145,6 +341,43 @@ type CondUsage struct {
 	// colon-separated suffix (like "[GOOS:linux]" for the "GOOS" condition).
 	// The suffix may be the empty string (like "[prefix:]").
 	Prefix bool
+
+	// If OptionalSuffix is true, a Prefix condition may also be used without
+	// a suffix (like "[symlink]"), in which case Eval receives the empty string.
+	OptionalSuffix bool
+}
+
+// RunScript executes the script named name with the given content in s,
+// as by Execute, and returns its log along with any error.
+//
+// The script also stops if ctx is done before it completes, in which case the
+// running command is canceled as though s's own Context had been. While the
+// script runs, s's Context is replaced by one that is canceled when either is
+// done; the original is restored, and the replacement canceled (stopping any
+// commands the script left running in the background), when RunScript returns.
+// Callers that need background commands to outlive the script should use
+// Execute instead.
+func (e *Engine) RunScript(ctx context.Context, name string, content []byte, s *State) (log string, err error) {
+	parent := s.ctx
+	runCtx, cancel := context.WithCancel(parent)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-done:
+		}
+	}()
+	s.ctx = runCtx
+	defer func() {
+		close(done)
+		cancel()
+		s.ctx = parent
+	}()
+
+	b := new(strings.Builder)
+	err = e.Execute(s, name, bufio.NewReader(bytes.NewReader(content)), b)
+	return b.String(), err
 }
 
 // Execute reads and executes script, writing the output to log.
@@ -162,6 +395,22 @@ func (e *Engine) Execute(s *State, file string, script *bufio.Reader, log io.Wri
 	defer func(prev *Engine) { s.engine = prev }(s.engine)
 	s.engine = e
 
+	// timedOut reports whether the context installed for e.Timeout (if any) has
+	// expired, as opposed to the one the State was given.
+	timedOut := func() bool { return false }
+	if e.Timeout > 0 {
+		parent := s.ctx
+		ctx, cancel := context.WithTimeout(parent, e.Timeout)
+		s.ctx = ctx
+		defer func() {
+			cancel()
+			s.ctx = parent
+		}()
+		timedOut = func() bool {
+			return ctx.Err() == context.DeadlineExceeded && parent.Err() == nil
+		}
+	}
+
 	var sectionStart time.Time
 	// endSection flushes the logs for the current section from s.log to log.
 	// ok indicates whether all commands in the section succeeded.
@@ -191,12 +440,15 @@ func (e *Engine) Execute(s *State, file string, script *bufio.Reader, log io.Wri
 		return err
 	}
 
-	var lineno int
+	var (
+		curFile = file // the file containing the line currently being executed
+		lineno  int    // the line currently being executed
+	)
 	lineErr := func(err error) error {
 		if errors.As(err, new(*CommandError)) {
 			return err
 		}
-		return fmt.Errorf("%s:%d: %w", file, lineno, err)
+		return fmt.Errorf("%s:%d: %w", curFile, lineno, err)
 	}
 
 	// In case of failure or panic, flush any pending logs for the section.
@@ -206,108 +458,489 @@ func (e *Engine) Execute(s *State, file string, script *bufio.Reader, log io.Wri
 		}
 	}()
 
-	for {
-		if err := s.ctx.Err(); err != nil {
-			// This error wasn't produced by any particular command,
-			// so don't wrap it in a CommandError.
-			return lineErr(err)
-		}
-
+	nread := 0
+	readLine := func() (scriptLine, bool, error) {
 		line, err := script.ReadString('\n')
 		if err == io.EOF {
 			if line == "" {
-				break // Reached the end of the script.
+				return scriptLine{}, false, nil // Reached the end of the script.
 			}
 			// If the script doesn't end in a newline, interpret the final line.
 		} else if err != nil {
-			return lineErr(err)
-		}
-		line = strings.TrimSuffix(line, "\n")
-		lineno++
-
-		// The comment character "#" at the start of the line delimits a section of
-		// the script.
-		if strings.HasPrefix(line, "#") {
-			// If there was a previous section, the fact that we are starting a new
-			// one implies the success of the previous one.
-			//
-			// At the start of the script, the state may also contain accumulated logs
-			// from commands executed on the State outside of the engine in order to
-			// set it up; flush those logs too.
-			if err := endSection(true); err != nil {
-				return lineErr(err)
-			}
-
-			// Log the section start without a newline so that we can add
-			// a timestamp for the section when it ends.
-			_, err = fmt.Fprintf(log, "%s", line)
-			sectionStart = time.Now()
+			return scriptLine{}, false, err
+		}
+		nread++
+		return scriptLine{file: file, text: strings.TrimSuffix(line, "\n"), lineno: nread}, true, nil
+	}
+
+	var includes []string // absolute paths of the files currently being included
+
+	// run executes the lines produced by next until next reports that there are
+	// no more lines, returning stopped == true if the script executed a 'stop'
+	// command.
+	var run func(next func() (scriptLine, bool, error)) (stopped bool, err error)
+	run = func(next func() (scriptLine, bool, error)) (bool, error) {
+		for {
+			if err := s.ctx.Err(); err != nil {
+				// This error wasn't produced by any particular command,
+				// so don't wrap it in a CommandError.
+				return false, lineErr(err)
+			}
+
+			l, ok, err := next()
 			if err != nil {
-				return lineErr(err)
+				return false, lineErr(err)
 			}
-			continue
-		}
+			if !ok {
+				return false, nil
+			}
+			line := l.text
+			curFile, lineno = l.file, l.lineno
+
+			// A "## NOTE:" line is an annotation to be copied to the log,
+			// rather than the start of a new section.
+			if note, ok := strings.CutPrefix(line, "## NOTE:"); ok {
+				note = strings.TrimSpace(note)
+				s.Logf("[NOTE] %s\n", note)
+				e.writeNote(curFile, lineno, line, note)
+				continue
+			}
+
+			// The comment character "#" at the start of the line delimits a section of
+			// the script.
+			if strings.HasPrefix(line, "#") {
+				// If there was a previous section, the fact that we are starting a new
+				// one implies the success of the previous one.
+				//
+				// At the start of the script, the state may also contain accumulated logs
+				// from commands executed on the State outside of the engine in order to
+				// set it up; flush those logs too.
+				if err := endSection(true); err != nil {
+					return false, lineErr(err)
+				}
+
+				// Log the section start without a newline so that we can add
+				// a timestamp for the section when it ends.
+				_, err = fmt.Fprintf(log, "%s", line)
+				sectionStart = time.Now()
+				if err != nil {
+					return false, lineErr(err)
+				}
+				continue
+			}
+
+			cmd, err := parse(curFile, lineno, line)
+			if cmd == nil && err == nil {
+				continue // Ignore blank lines.
+			}
+			s.Logf("> %s\n", line)
+			if err == nil {
+				err = e.expandAlias(cmd)
+			}
+			if err != nil {
+				e.writeRecord(curFile, lineno, line, false, time.Time{}, err)
+				return false, lineErr(err)
+			}
+			if term, quoted, ok := heredocTerm(cmd); ok {
+				doc, err := readHeredoc(next, term)
+				if err != nil {
+					return false, lineErr(err)
+				}
+				for _, l := range doc {
+					s.Logf("%s\n", l.text)
+				}
+				var b strings.Builder
+				for _, l := range doc[:len(doc)-1] {
+					b.WriteString(l.text)
+					b.WriteString("\n")
+				}
+				cmd.rawArgs[len(cmd.rawArgs)-1] = []argFragment{{s: b.String(), quoted: quoted}}
+			}
+
+			var body []scriptLine
+			switch cmd.name {
+			case "end":
+				return false, lineErr(errors.New("'end' without matching 'repeat' or 'foreach'"))
+			case "repeat", "foreach", "include":
+				if cmd.want != "" || cmd.background || cmd.timeout != 0 || cmd.assign != "" {
+					return false, lineErr(fmt.Errorf("'%s' accepts only condition prefixes", cmd.name))
+				}
+				if cmd.name != "include" {
+					body, err = readBlock(next, &lineno)
+					if err != nil {
+						return false, lineErr(err)
+					}
+				}
+			}
+
+			// Evaluate condition guards.
+			ok, err = e.conditionsActive(s, cmd.conds)
+			if err != nil {
+				e.writeRecord(curFile, lineno, line, false, time.Time{}, err)
+				return false, lineErr(err)
+			}
+			if !ok {
+				s.Logf("[condition not met]\n")
+				e.writeRecord(curFile, lineno, line, false, time.Time{}, nil)
+				if body == nil {
+					info := &CommandInfo{File: curFile, Line: lineno, Name: cmd.name, Skipped: true}
+					e.beforeCommand(s, info)
+					e.afterCommand(s, info, nil, 0)
+				}
+				continue
+			}
+
+			impl := e.Cmds[cmd.name]
+
+			// Expand variables in arguments.
+			var regexpArgs []int
+			if impl != nil && body == nil {
+				usage := impl.Usage()
+				if usage.RegexpArgs != nil {
+					// First join rawArgs without expansion to pass to RegexpArgs.
+					rawArgs := make([]string, 0, len(cmd.rawArgs))
+					for _, frags := range cmd.rawArgs {
+						var b strings.Builder
+						for _, frag := range frags {
+							b.WriteString(frag.s)
+						}
+						rawArgs = append(rawArgs, b.String())
+					}
+					regexpArgs = usage.RegexpArgs(rawArgs...)
+				}
+			}
+			cmd.args = expandArgs(s, cmd.rawArgs, regexpArgs)
 
-		cmd, err := parse(file, lineno, line)
-		if cmd == nil && err == nil {
-			continue // Ignore blank lines.
+			if cmd.name == "include" {
+				lines, err := readInclude(s, cmd, includes)
+				if err != nil {
+					return false, lineErr(err)
+				}
+				includes = append(includes, s.Path(cmd.args[0]))
+				inFile, inLine := curFile, lineno
+				i := 0
+				stopped, err := run(func() (scriptLine, bool, error) {
+					if i >= len(lines) {
+						return scriptLine{}, false, nil
+					}
+					i++
+					return lines[i-1], true, nil
+				})
+				includes = includes[:len(includes)-1]
+				curFile, lineno = inFile, inLine
+				if stopped || err != nil {
+					return stopped, err
+				}
+				continue
+			}
+
+			if body != nil {
+				headerFile, header := curFile, lineno
+				vars, values, err := loopValues(cmd)
+				if err != nil {
+					return false, lineErr(err)
+				}
+				start := time.Now()
+				stopped, err := runLoop(s, vars, values, func() (bool, error) {
+					i := 0
+					return run(func() (scriptLine, bool, error) {
+						if i >= len(body) {
+							return scriptLine{}, false, nil
+						}
+						i++
+						return body[i-1], true, nil
+					})
+				})
+				e.writeRecord(headerFile, header, line, true, start, err)
+				if stopped || err != nil {
+					return stopped, err
+				}
+				continue
+			}
+
+			// Run the command.
+			info := &CommandInfo{File: curFile, Line: lineno, Name: cmd.name, Args: append([]string{}, cmd.args...)}
+			e.beforeCommand(s, info)
+			start := time.Now()
+			err = e.runCommand(s, cmd, impl)
+			if timedOut() {
+				err = e.timeoutError(cmd, err)
+			}
+			e.afterCommand(s, info, err, time.Since(start))
+			e.writeRecord(curFile, lineno, line, true, start, err)
+			if err != nil {
+				if stop := (stopError{}); errors.As(err, &stop) {
+					// Since the 'stop' command halts execution of the entire script,
+					// log its message separately from the section in which it appears.
+					err = endSection(true)
+					s.Logf("%v\n", stop)
+					if err == nil {
+						return true, nil
+					}
+				}
+				return false, lineErr(err)
+			}
 		}
-		s.Logf("> %s\n", line)
-		if err != nil {
-			return lineErr(err)
+	}
+
+	if stopped, err := run(readLine); stopped || err != nil {
+		return err
+	}
+
+	if err := endSection(true); err != nil {
+		return lineErr(err)
+	}
+	return nil
+}
+
+// timeoutError returns the error to report for cmd, which was running when
+// e.Timeout expired and returned err.
+func (e *Engine) timeoutError(cmd *command, err error) error {
+	msg := fmt.Sprintf("script did not complete within Engine.Timeout (%v)", e.Timeout)
+	var cmdErr *CommandError
+	if errors.As(err, &cmdErr) && !errors.As(err, new(stopError)) {
+		cmdErr.Err = fmt.Errorf("%s: %w", msg, cmdErr.Err)
+		return cmdErr
+	}
+	return cmdError(cmd, errors.New(msg))
+}
+
+// A scriptLine is a single line of a script, without its trailing newline.
+type scriptLine struct {
+	file   string
+	text   string
+	lineno int
+}
+
+// readInclude reads the lines of the file included by the 'include' command
+// cmd, which must not already be among the absolute paths in includes.
+func readInclude(s *State, cmd *command, includes []string) ([]scriptLine, error) {
+	if len(cmd.args) != 1 {
+		return nil, errors.New("usage: include file")
+	}
+	name := cmd.args[0]
+	path, err := s.ResolvePath(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range includes {
+		if p == path {
+			return nil, fmt.Errorf("include cycle: %s includes itself", name)
 		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
 
-		// Evaluate condition guards.
-		ok, err := e.conditionsActive(s, cmd.conds)
+	text := strings.TrimSuffix(string(data), "\n")
+	if text == "" {
+		return nil, nil
+	}
+	var lines []scriptLine
+	for i, line := range strings.Split(text, "\n") {
+		lines = append(lines, scriptLine{file: name, text: line, lineno: i + 1})
+	}
+	return lines, nil
+}
+
+// readBlock reads the lines following a 'repeat' or 'foreach' line from next,
+// up to (but not including) the matching 'end' line.
+// If the 'end' line is malformed, readBlock sets *lineno to its line number.
+func readBlock(next func() (scriptLine, bool, error), lineno *int) ([]scriptLine, error) {
+	body := []scriptLine{}
+	depth := 1
+	for {
+		l, ok, err := next()
 		if err != nil {
-			return lineErr(err)
+			return nil, err
 		}
 		if !ok {
-			s.Logf("[condition not met]\n")
-			continue
+			return nil, errors.New("missing 'end' for block")
 		}
-
-		impl := e.Cmds[cmd.name]
-
-		// Expand variables in arguments.
-		var regexpArgs []int
-		if impl != nil {
-			usage := impl.Usage()
-			if usage.RegexpArgs != nil {
-				// First join rawArgs without expansion to pass to RegexpArgs.
-				rawArgs := make([]string, 0, len(cmd.rawArgs))
-				for _, frags := range cmd.rawArgs {
-					var b strings.Builder
-					for _, frag := range frags {
-						b.WriteString(frag.s)
+		if !strings.HasPrefix(l.text, "#") {
+			if cmd, err := parse("", l.lineno, l.text); err == nil && cmd != nil {
+				if term, _, ok := heredocTerm(cmd); ok {
+					// The lines of a here document are not commands, even if they
+					// look like 'end'.
+					doc, err := readHeredoc(next, term)
+					if err != nil {
+						*lineno = l.lineno
+						return nil, err
+					}
+					body = append(body, l)
+					body = append(body, doc...)
+					continue
+				}
+				switch cmd.name {
+				case "repeat", "foreach":
+					depth++
+				case "end":
+					depth--
+					if depth == 0 {
+						if len(cmd.rawArgs) > 0 || len(cmd.conds) > 0 || cmd.want != "" || cmd.background || cmd.timeout != 0 {
+							*lineno = l.lineno
+							return nil, errors.New("'end' accepts no arguments or prefixes")
+						}
+						return body, nil
 					}
-					rawArgs = append(rawArgs, b.String())
 				}
-				regexpArgs = usage.RegexpArgs(rawArgs...)
 			}
 		}
-		cmd.args = expandArgs(s, cmd.rawArgs, regexpArgs)
+		body = append(body, l)
+	}
+}
 
-		// Run the command.
-		err = e.runCommand(s, cmd, impl)
+// heredocTerm reports whether the last argument of cmd has the form <<TERM,
+// introducing a here document, and if so returns TERM and whether any part of
+// it was quoted.
+func heredocTerm(cmd *command) (term string, quoted, ok bool) {
+	if len(cmd.rawArgs) == 0 {
+		return "", false, false
+	}
+	last := cmd.rawArgs[len(cmd.rawArgs)-1]
+	if last[0].quoted || !strings.HasPrefix(last[0].s, "<<") {
+		return "", false, false
+	}
+	var b strings.Builder
+	for _, frag := range last {
+		b.WriteString(frag.s)
+		quoted = quoted || frag.quoted
+	}
+	term = strings.TrimPrefix(b.String(), "<<")
+	if term == "" {
+		return "", false, false
+	}
+	return term, quoted, true
+}
+
+// readHeredoc reads the lines produced by next up to and including a line
+// consisting of exactly term.
+func readHeredoc(next func() (scriptLine, bool, error), term string) ([]scriptLine, error) {
+	var doc []scriptLine
+	for {
+		l, ok, err := next()
 		if err != nil {
-			if stop := (stopError{}); errors.As(err, &stop) {
-				// Since the 'stop' command halts execution of the entire script,
-				// log its message separately from the section in which it appears.
-				err = endSection(true)
-				s.Logf("%v\n", s)
-				if err == nil {
-					return nil
-				}
-			}
-			return lineErr(err)
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("missing %q terminating here document", term)
+		}
+		doc = append(doc, l)
+		if l.text == term {
+			return doc, nil
 		}
 	}
+}
 
-	if err := endSection(true); err != nil {
-		return lineErr(err)
+// loopValues returns the name of the variable to set on each iteration of the
+// 'repeat' or 'foreach' block cmd, and the successive values for it.
+func loopValues(cmd *command) (name string, values []string, err error) {
+	switch cmd.name {
+	case "repeat":
+		if len(cmd.args) != 1 {
+			return "", nil, errors.New("usage: repeat N")
+		}
+		n, err := strconv.Atoi(cmd.args[0])
+		if err != nil || n < 0 {
+			return "", nil, fmt.Errorf("repeat: invalid count %q", cmd.args[0])
+		}
+		for i := 0; i < n; i++ {
+			values = append(values, strconv.Itoa(i))
+		}
+		return "ITER", values, nil
+
+	case "foreach":
+		if len(cmd.args) < 2 || cmd.args[1] != "in" || cmd.args[0] == "" || strings.Contains(cmd.args[0], "=") {
+			return "", nil, errors.New("usage: foreach var in values...")
+		}
+		return cmd.args[0], cmd.args[2:], nil
 	}
-	return nil
+	panic("unreachable")
+}
+
+// runLoop calls body once for each value, with the variable name set to that
+// value. Afterward, it restores the variable to its previous state.
+func runLoop(s *State, name string, values []string, body func() (stopped bool, err error)) (stopped bool, err error) {
+	prev, wasSet := s.LookupEnv(name)
+	defer func() {
+		var restoreErr error
+		if wasSet {
+			restoreErr = s.Setenv(name, prev)
+		} else {
+			restoreErr = s.Unsetenv(name)
+		}
+		if err == nil {
+			err = restoreErr
+		}
+	}()
+
+	for _, v := range values {
+		s.Logf("[%s=%s]\n", name, v)
+		if err := s.Setenv(name, v); err != nil {
+			return false, err
+		}
+		if stopped, err := body(); stopped || err != nil {
+			return stopped, err
+		}
+	}
+	return false, nil
+}
+
+// writeNote writes a CommandRecord for a '## NOTE:' line to e.JSONLog,
+// if it is set.
+func (e *Engine) writeNote(file string, line int, text, note string) {
+	if e.JSONLog == nil {
+		return
+	}
+	b, err := json.Marshal(CommandRecord{File: file, Line: line, Command: text, Note: note})
+	if err != nil {
+		return
+	}
+	e.JSONLog.Write(append(b, '\n'))
+}
+
+// beforeCommand calls e.BeforeCommand, if it is set.
+func (e *Engine) beforeCommand(s *State, info *CommandInfo) {
+	if e.BeforeCommand != nil {
+		e.BeforeCommand(s, info)
+	}
+}
+
+// afterCommand calls e.AfterCommand, if it is set.
+func (e *Engine) afterCommand(s *State, info *CommandInfo, err error, elapsed time.Duration) {
+	if e.AfterCommand == nil {
+		return
+	}
+	if stop := (stopError{}); errors.As(err, &stop) {
+		err = nil
+	}
+	e.AfterCommand(s, info, err, elapsed)
+}
+
+// writeRecord writes a CommandRecord to e.JSONLog, if it is set.
+// Errors writing the record are ignored: the record is diagnostic only.
+func (e *Engine) writeRecord(file string, line int, text string, condsMet bool, start time.Time, err error) {
+	if e.JSONLog == nil {
+		return
+	}
+	r := CommandRecord{
+		File:     file,
+		Line:     line,
+		Command:  text,
+		CondsMet: condsMet,
+	}
+	if !start.IsZero() {
+		r.Elapsed = time.Since(start).Seconds()
+	}
+	if stop := (stopError{}); err != nil && !errors.As(err, &stop) {
+		r.Error = err.Error()
+	}
+	b, jsonErr := json.Marshal(r)
+	if jsonErr != nil {
+		return
+	}
+	e.JSONLog.Write(append(b, '\n'))
 }
 
 // A command is a complete command parsed from a script.
@@ -318,8 +951,11 @@ type command struct {
 	conds      []condition // all must be satisfied
 	name       string      // the name of the command; must be non-empty
 	rawArgs    [][]argFragment
-	args       []string // shell-expanded arguments following name
-	background bool     // command should run in background (ends with a trailing &)
+	args       []string      // shell-expanded arguments following name
+	background bool          // command should run in background (ends with a trailing & or has a bgName)
+	bgName     string        // if non-empty, the name of the background command (from a -bg=name argument)
+	timeout    time.Duration // if nonzero, limit on the command's execution time
+	assign     string        // if non-empty, the variable to which to assign the command's stdout
 }
 
 // A expectedStatus describes the expected outcome of a command.
@@ -332,6 +968,16 @@ const (
 	successOrFailure expectedStatus = "?"
 )
 
+// dquoteEscapes maps the characters that may follow a backslash within a
+// double-quoted argument to the text that the escape sequence denotes.
+var dquoteEscapes = map[byte]string{
+	'"':  `"`,
+	'\\': `\`,
+	'$':  "$",
+	'n':  "\n",
+	't':  "\t",
+}
+
 type argFragment struct {
 	s      string
 	quoted bool // if true, disable variable expansion for this fragment
@@ -339,7 +985,7 @@ type argFragment struct {
 
 type condition struct {
 	want bool
-	tag  string
+	tags []string // alternatives; the condition is active if any tag is
 }
 
 const argSepChars = " \t\r\n#"
@@ -353,9 +999,10 @@ const argSepChars = " \t\r\n#"
 func parse(filename string, lineno int, line string) (cmd *command, err error) {
 	cmd = &command{file: filename, line: lineno}
 	var (
-		rawArg []argFragment // text fragments of current arg so far (need to add line[start:i])
-		start  = -1          // if >= 0, position where current arg text chunk starts
-		quoted = false       // currently processing quoted text
+		rawArg  []argFragment // text fragments of current arg so far (need to add line[start:i])
+		start   = -1          // if >= 0, position where current arg text chunk starts
+		quoted  = false       // currently processing quoted text
+		dquoted = false       // currently processing double-quoted text
 	)
 
 	flushArg := func() error {
@@ -379,21 +1026,27 @@ func parse(filename string, lineno int, line string) (cmd *command, err error) {
 				return nil
 			}
 
-			// Command prefix [cond] means only run this command if cond is satisfied.
-			if strings.HasPrefix(arg, "[") && strings.HasSuffix(arg, "]") {
-				want := true
-				arg = strings.TrimSpace(arg[1 : len(arg)-1])
-				if strings.HasPrefix(arg, "!") {
-					want = false
-					arg = strings.TrimSpace(arg[1:])
-				}
-				if arg == "" {
-					return errors.New("empty condition")
+			// Command prefixes in brackets, like [cond] or [timeout=D], may be
+			// written adjacent to one another, like [linux][!race], as well as
+			// separated by spaces.
+			if groups, ok := splitBrackets(arg); ok {
+				for _, g := range groups {
+					if err := parsePrefix(cmd, g); err != nil {
+						return err
+					}
 				}
-				cmd.conds = append(cmd.conds, condition{want: want, tag: arg})
 				return nil
 			}
 
+			// A command of the form var=name assigns the command's output to var.
+			if v, name, ok := strings.Cut(arg, "="); ok {
+				if !isVarName(v) || name == "" {
+					return fmt.Errorf("malformed assignment %q", arg)
+				}
+				cmd.assign = v
+				arg = name
+			}
+
 			if arg == "" {
 				return errors.New("empty command")
 			}
@@ -406,7 +1059,7 @@ func parse(filename string, lineno int, line string) (cmd *command, err error) {
 	}
 
 	for i := 0; ; i++ {
-		if !quoted && (i >= len(line) || strings.ContainsRune(argSepChars, rune(line[i]))) {
+		if !quoted && !dquoted && (i >= len(line) || strings.ContainsRune(argSepChars, rune(line[i]))) {
 			// Found arg-separating space.
 			if start >= 0 {
 				rawArg = append(rawArg, argFragment{s: line[start:i], quoted: false})
@@ -423,6 +1076,35 @@ func parse(filename string, lineno int, line string) (cmd *command, err error) {
 		if i >= len(line) {
 			return nil, errors.New("unterminated quoted argument")
 		}
+		if dquoted {
+			switch line[i] {
+			case '"':
+				// ending a double-quoted chunk
+				rawArg = append(rawArg, argFragment{s: line[start:i], quoted: false})
+				start = i + 1
+				dquoted = false
+			case '\\':
+				if i+1 < len(line) {
+					if esc, ok := dquoteEscapes[line[i+1]]; ok {
+						rawArg = append(rawArg,
+							argFragment{s: line[start:i], quoted: false},
+							argFragment{s: esc, quoted: true})
+						i++ // skip over escaped character before next iteration
+						start = i + 1
+					}
+				}
+			}
+			continue
+		}
+		if line[i] == '"' && start < 0 && len(rawArg) == 0 {
+			// Starting a double-quoted chunk at the beginning of an argument.
+			// The empty quoted fragment marks the argument as quoted, so that it
+			// is never interpreted as a command name or prefix.
+			rawArg = append(rawArg, argFragment{s: "", quoted: true})
+			start = i + 1
+			dquoted = true
+			continue
+		}
 		if line[i] == '\'' {
 			if !quoted {
 				// starting a quoted chunk
@@ -453,7 +1135,7 @@ func parse(filename string, lineno int, line string) (cmd *command, err error) {
 	}
 
 	if cmd.name == "" {
-		if cmd.want != "" || len(cmd.conds) > 0 || len(cmd.rawArgs) > 0 || cmd.background {
+		if cmd.want != "" || len(cmd.conds) > 0 || len(cmd.rawArgs) > 0 || cmd.background || cmd.timeout != 0 {
 			// The line contains a command prefix or suffix, but no actual command.
 			return nil, errors.New("missing command")
 		}
@@ -472,6 +1154,34 @@ func parse(filename string, lineno int, line string) (cmd *command, err error) {
 	return cmd, nil
 }
 
+// expandAlias replaces the name of cmd by its expansion in e.Aliases, if any,
+// until the name is not an alias or names an alias that was already expanded.
+func (e *Engine) expandAlias(cmd *command) error {
+	var expanded []string
+	for {
+		text, ok := e.Aliases[cmd.name]
+		if !ok {
+			return nil
+		}
+		for _, name := range expanded {
+			if name == cmd.name {
+				return nil
+			}
+		}
+
+		alias, err := parse(cmd.file, cmd.line, text)
+		if err != nil {
+			return fmt.Errorf("alias %s: %w", cmd.name, err)
+		}
+		if alias == nil || alias.want != "" || len(alias.conds) > 0 || alias.background || alias.timeout != 0 || alias.assign != "" {
+			return fmt.Errorf("alias %s: expansion %q is not a command", cmd.name, text)
+		}
+		expanded = append(expanded, cmd.name)
+		cmd.name = alias.name
+		cmd.rawArgs = append(alias.rawArgs, cmd.rawArgs...)
+	}
+}
+
 // expandArgs expands the shell variables in rawArgs and joins them to form the
 // final arguments to pass to a command.
 func expandArgs(s *State, rawArgs [][]argFragment, regexpArgs []int) []string {
@@ -507,7 +1217,7 @@ func quoteArgs(args []string) string {
 		if i > 0 {
 			b.WriteString(" ")
 		}
-		if strings.ContainsAny(arg, "'"+argSepChars) {
+		if strings.ContainsAny(arg, "'"+argSepChars) || strings.HasPrefix(arg, `"`) {
 			// Quote the argument to a form that would be parsed as a single argument.
 			b.WriteString("'")
 			b.WriteString(strings.ReplaceAll(arg, "'", "''"))
@@ -521,29 +1231,28 @@ func quoteArgs(args []string) string {
 
 func (e *Engine) conditionsActive(s *State, conds []condition) (bool, error) {
 	for _, cond := range conds {
-		var impl Cond
-		prefix, suffix, ok := strings.Cut(cond.tag, ":")
-		if ok {
-			impl = e.Conds[prefix]
-			if impl == nil {
-				return false, fmt.Errorf("unknown condition prefix %q", prefix)
-			}
-			if !impl.Usage().Prefix {
-				return false, fmt.Errorf("condition %q cannot be used with a suffix", prefix)
-			}
-		} else {
-			impl = e.Conds[cond.tag]
-			if impl == nil {
-				return false, fmt.Errorf("unknown condition %q", cond.tag)
-			}
-			if impl.Usage().Prefix {
-				return false, fmt.Errorf("condition %q requires a suffix", cond.tag)
+		// Resolve every alternative before evaluating any of them, so that a
+		// misspelled condition is reported even if an earlier one is active.
+		impls := make([]Cond, len(cond.tags))
+		suffixes := make([]string, len(cond.tags))
+		for i, tag := range cond.tags {
+			impl, suffix, err := e.lookupCond(tag)
+			if err != nil {
+				return false, err
 			}
+			impls[i], suffixes[i] = impl, suffix
 		}
-		active, err := impl.Eval(s, suffix)
 
-		if err != nil {
-			return false, fmt.Errorf("evaluating condition %q: %w", cond.tag, err)
+		active := false
+		for i, impl := range impls {
+			var err error
+			active, err = impl.Eval(s, suffixes[i])
+			if err != nil {
+				return false, fmt.Errorf("evaluating condition %q: %w", cond.tags[i], err)
+			}
+			if active {
+				break
+			}
 		}
 		if active != cond.want {
 			return false, nil
@@ -553,32 +1262,112 @@ func (e *Engine) conditionsActive(s *State, conds []condition) (bool, error) {
 	return true, nil
 }
 
+// lookupCond returns the Cond registered for tag, which has the form "name" or
+// "name:suffix", along with the suffix to pass to its Eval method.
+func (e *Engine) lookupCond(tag string) (impl Cond, suffix string, err error) {
+	prefix, suffix, ok := strings.Cut(tag, ":")
+	if ok {
+		impl = e.Conds[prefix]
+		if impl == nil {
+			return nil, "", fmt.Errorf("unknown condition prefix %q", prefix)
+		}
+		if !impl.Usage().Prefix {
+			return nil, "", fmt.Errorf("condition %q cannot be used with a suffix", prefix)
+		}
+	} else {
+		impl = e.Conds[tag]
+		if impl == nil {
+			return nil, "", fmt.Errorf("unknown condition %q", tag)
+		}
+		if usage := impl.Usage(); usage.Prefix && !usage.OptionalSuffix {
+			return nil, "", fmt.Errorf("condition %q requires a suffix", tag)
+		}
+	}
+	return impl, suffix, nil
+}
+
 func (e *Engine) runCommand(s *State, cmd *command, impl Cmd) error {
 	if impl == nil {
 		return cmdError(cmd, errors.New("unknown command"))
 	}
 
 	async := impl.Usage().Async
-	if cmd.background && !async {
-		return cmdError(cmd, errors.New("command cannot be run in background"))
+	if async && len(cmd.args) > 0 && strings.HasPrefix(cmd.args[0], "-bg=") {
+		name := strings.TrimPrefix(cmd.args[0], "-bg=")
+		if name == "" {
+			return cmdError(cmd, errors.New("empty background command name"))
+		}
+		if _, ok := s.named[name]; ok {
+			return cmdError(cmd, fmt.Errorf("background command %q is already running", name))
+		}
+		cmd.bgName = name
+		cmd.background = true
+		cmd.args = cmd.args[1:]
+	}
+	if cmd.background && cmd.assign != "" {
+		return cmdError(cmd, errors.New("cannot assign the output of a background command"))
 	}
 
-	wait, runErr := impl.Run(s, cmd.args...)
+	if e.DryRun && !impl.Usage().ReadOnly {
+		s.Logf("[dry run: command skipped]\n")
+		return nil
+	}
+
+	defer func(prev *command) { s.running = prev }(s.running)
+	s.running = cmd
+	wait, cancel, runErr := runWithContext(s, cmd, impl)
+	if cmd.background && !async && !errors.Is(runErr, ErrUsage) && !errors.As(runErr, new(stopError)) {
+		// The command has already run to completion, but its results are
+		// reported by 'wait', like those of any other background command.
+		if runErr != nil {
+			wait = func(*State) (stdout, stderr string, err error) { return "", "", runErr }
+		} else if wait == nil {
+			wait = func(*State) (stdout, stderr string, err error) { return "", "", nil }
+		}
+		runErr = nil
+	}
 	if wait == nil {
 		if async && runErr == nil {
 			return cmdError(cmd, errors.New("internal error: async command returned a nil WaitFunc"))
 		}
-		return checkStatus(cmd, runErr)
+		if e.UpdateGolden && cmd.want == success {
+			if mismatch := (*mismatchError)(nil); errors.As(runErr, &mismatch) {
+				updated, err := s.updateArchiveFile(mismatch.path, mismatch.data)
+				if err != nil {
+					return cmdError(cmd, err)
+				}
+				if updated {
+					s.Logf("[updated %s]\n", mismatch.name)
+					return nil
+				}
+			}
+		}
+		if err := checkStatus(cmd, runErr); err != nil {
+			return err
+		}
+		if cmd.assign != "" && runErr == nil {
+			// The command produced no output.
+			s.Setenv(cmd.assign, "")
+		}
+		return nil
 	}
 	if runErr != nil {
 		return cmdError(cmd, errors.New("internal error: command returned both an error and a WaitFunc"))
 	}
 
 	if cmd.background {
-		s.background = append(s.background, backgroundCmd{
+		bg := &backgroundCmd{
 			command: cmd,
 			wait:    wait,
-		})
+			cancel:  cancel,
+		}
+		s.background = append(s.background, bg)
+		if cmd.bgName != "" {
+			if s.named == nil {
+				s.named = make(map[string]*backgroundCmd)
+			}
+			s.named[cmd.bgName] = bg
+		}
 		// Clear stdout and stderr, since they no longer correspond to the last
 		// command executed.
 		s.stdout = ""
@@ -599,6 +1388,9 @@ func (e *Engine) runCommand(s *State, cmd *command, impl Cmd) error {
 		if cmdErr := checkStatus(cmd, waitErr); cmdErr != nil {
 			return cmdErr
 		}
+		if cmd.assign != "" && waitErr == nil {
+			s.Setenv(cmd.assign, strings.TrimSpace(stdout))
+		}
 		if waitErr != nil {
 			// waitErr was expected (by cmd.want), so log it instead of returning it.
 			s.Logf("[%v]\n", waitErr)
@@ -607,6 +1399,169 @@ func (e *Engine) runCommand(s *State, cmd *command, impl Cmd) error {
 	return nil
 }
 
+// runSubcommand runs a command on behalf of another command, such as 'defer'
+// or 'retry', in the same way as Execute runs a command from the script, so
+// that e.BeforeCommand, e.AfterCommand, e.JSONLog, and e.DryRun apply to it.
+// Any alias in cmd.name must already have been expanded.
+func (e *Engine) runSubcommand(s *State, cmd *command) error {
+	cmd.args = expandArgs(s, cmd.rawArgs, nil)
+	text := cmd.name
+	if len(cmd.args) > 0 {
+		text += " " + quoteArgs(cmd.args)
+	}
+	info := &CommandInfo{File: cmd.file, Line: cmd.line, Name: cmd.name, Args: append([]string{}, cmd.args...)}
+	e.beforeCommand(s, info)
+	start := time.Now()
+	err := e.runCommand(s, cmd, e.Cmds[cmd.name])
+	e.afterCommand(s, info, err, time.Since(start))
+	e.writeRecord(cmd.file, cmd.line, text, true, start, err)
+	return err
+}
+
+// splitBrackets reports whether arg consists entirely of one or more
+// bracketed groups, like "[linux]" or "[linux][!race]", and if so returns the
+// text of each group including its brackets.
+func splitBrackets(arg string) (groups []string, ok bool) {
+	for arg != "" {
+		if arg[0] != '[' {
+			return nil, false
+		}
+		// Brackets may nest within a group, as in a regular expression
+		// passed to a condition.
+		depth, end := 0, -1
+		for i := 0; i < len(arg) && end < 0; i++ {
+			switch arg[i] {
+			case '[':
+				depth++
+			case ']':
+				if depth--; depth == 0 {
+					end = i
+				}
+			}
+		}
+		if end < 0 {
+			return nil, false
+		}
+		groups = append(groups, arg[:end+1])
+		arg = arg[end+1:]
+	}
+	return groups, len(groups) > 0
+}
+
+// parsePrefix parses a single bracketed command prefix, like "[cond]" or
+// "[timeout=D]", into cmd.
+func parsePrefix(cmd *command, arg string) error {
+	// Command prefix [timeout=D] limits the command's execution time.
+	if strings.HasPrefix(arg, "[timeout=") {
+		if cmd.timeout != 0 {
+			return errors.New("duplicated timeout")
+		}
+		d, err := time.ParseDuration(arg[len("[timeout=") : len(arg)-1])
+		if err != nil {
+			return fmt.Errorf("invalid timeout: %w", err)
+		}
+		if d <= 0 {
+			return errors.New("invalid timeout: must be positive")
+		}
+		cmd.timeout = d
+		return nil
+	}
+
+	// Command prefix [cond] means only run this command if cond is satisfied.
+	want := true
+	arg = strings.TrimSpace(arg[1 : len(arg)-1])
+	if strings.HasPrefix(arg, "!") {
+		want = false
+		arg = strings.TrimSpace(arg[1:])
+	}
+	if arg == "" {
+		return errors.New("empty condition")
+	}
+	var tags []string
+	for _, tag := range strings.Split(arg, "|") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			return errors.New("empty alternative in condition")
+		}
+		if strings.HasPrefix(tag, "!") {
+			return errors.New("'!' must precede the entire condition")
+		}
+		tags = append(tags, tag)
+	}
+	cmd.conds = append(cmd.conds, condition{want: want, tags: tags})
+	return nil
+}
+
+// isVarName reports whether name is a valid variable name for an assignment:
+// a letter or underscore followed by letters, digits, and underscores.
+func isVarName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		switch {
+		case r == '_', 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z':
+		case i > 0 && '0' <= r && r <= '9':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// runWithContext runs impl with the arguments of cmd.
+//
+// If cmd has a timeout or a background name, the State's Context is replaced
+// for the duration of the Run call and the resulting WaitFunc by one that
+// expires after the timeout or when the returned CancelFunc is called.
+// Otherwise, the returned CancelFunc is nil.
+func runWithContext(s *State, cmd *command, impl Cmd) (WaitFunc, context.CancelFunc, error) {
+	if cmd.timeout == 0 && !cmd.background {
+		wait, err := impl.Run(s, cmd.args...)
+		return wait, nil, err
+	}
+
+	parent := s.ctx
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+	if cmd.timeout != 0 {
+		ctx, cancel = context.WithTimeout(parent, cmd.timeout)
+	} else {
+		ctx, cancel = context.WithCancel(parent)
+	}
+	s.ctx = ctx
+	wait, err := impl.Run(s, cmd.args...)
+	s.ctx = parent
+
+	if wait == nil {
+		cancel()
+		return nil, nil, timeoutErr(s, cmd, ctx, parent, err)
+	}
+	return func(s *State) (stdout, stderr string, err error) {
+		defer cancel()
+		prev := s.ctx
+		s.ctx = ctx
+		stdout, stderr, err = wait(s)
+		s.ctx = prev
+		return stdout, stderr, timeoutErr(s, cmd, ctx, parent, err)
+	}, cancel, nil
+}
+
+// timeoutErr replaces err with an error that reports the expiration of cmd's
+// timeout, if the failure was caused by that expiration rather than
+// cancellation of the parent Context.
+func timeoutErr(s *State, cmd *command, ctx, parent context.Context, err error) error {
+	if err == nil || ctx.Err() != context.DeadlineExceeded || parent.Err() != nil {
+		return err
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		s.Logf("[%v]\n", err)
+	}
+	return fmt.Errorf("command %q exceeded timeout (%v): %w", cmd.name, cmd.timeout, context.DeadlineExceeded)
+}
+
 func checkStatus(cmd *command, err error) error {
 	if err == nil {
 		if cmd.want == failure {
@@ -665,12 +1620,16 @@ func (e *Engine) ListCmds(w io.Writer, verbose bool, names ...string) error {
 		cmd := e.Cmds[name]
 		usage := cmd.Usage()
 
+		args := usage.Args
+		if args != "" {
+			args = " " + args
+		}
 		suffix := ""
 		if usage.Async {
 			suffix = " [&]"
 		}
 
-		_, err := fmt.Fprintf(w, "%s %s%s\n\t%s\n", name, usage.Args, suffix, usage.Summary)
+		_, err := fmt.Fprintf(w, "%s%s%s\n\t%s\n", name, args, suffix, usage.Summary)
 		if err != nil {
 			return err
 		}
@@ -769,7 +1728,12 @@ func (e *Engine) ListConds(w io.Writer, s *State, tags ...string) error {
 		var err error
 		usage := cond.Usage()
 		if usage.Prefix {
-			_, err = fmt.Fprintf(w, "[%s:*]\n\t%s\n", tag, usage.Summary)
+			if usage.OptionalSuffix {
+				tag += "[:*]"
+			} else {
+				tag += ":*"
+			}
+			_, err = fmt.Fprintf(w, "[%s]\n\t%s\n", tag, usage.Summary)
 		} else {
 			activeStr := ""
 			if s != nil {
@@ -786,3 +1750,29 @@ func (e *Engine) ListConds(w io.Writer, s *State, tags ...string) error {
 
 	return nil
 }
+
+// Commands returns the usage of each command registered in e, keyed by
+// command name.
+//
+// The returned map is newly allocated, but the CmdUsage values are those
+// reported by each command's Usage method and must not be modified.
+func (e *Engine) Commands() map[string]*CmdUsage {
+	m := make(map[string]*CmdUsage, len(e.Cmds))
+	for name, cmd := range e.Cmds {
+		m[name] = cmd.Usage()
+	}
+	return m
+}
+
+// Conditions returns the usage of each condition registered in e, keyed by
+// condition name (without any suffix).
+//
+// The returned map is newly allocated, but the CondUsage values are those
+// reported by each condition's Usage method and must not be modified.
+func (e *Engine) Conditions() map[string]*CondUsage {
+	m := make(map[string]*CondUsage, len(e.Conds))
+	for name, cond := range e.Conds {
+		m[name] = cond.Usage()
+	}
+	return m
+}
@@ -0,0 +1,809 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package script
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"internal/testenv"
+	"internal/txtar"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	e := NewEngine()
+	for _, tt := range []struct {
+		script   string
+		wantErr  string
+		attempts int
+	}{
+		{script: "retry -count=3 exists\n", wantErr: "test.txt:1: exists: invalid usage", attempts: 0},
+		{script: "retry -count=3 exists missing.txt\n", wantErr: "test.txt:1: exists missing.txt: ", attempts: 2},
+		{script: "! retry -count=2 exists missing.txt\n", attempts: 1},
+	} {
+		s, err := NewState(context.Background(), t.TempDir(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		log := new(strings.Builder)
+		err = e.Execute(s, "test.txt", bufio.NewReader(strings.NewReader(tt.script)), log)
+		s.CloseAndWait(log)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%q: %v\n%s", tt.script, err, log)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%q: error %v; want %q", tt.script, err, tt.wantErr)
+		}
+		if n := strings.Count(log.String(), "[attempt "); n != tt.attempts {
+			t.Errorf("%q: logged %d failed attempts; want %d\n%s", tt.script, n, tt.attempts, log)
+		}
+	}
+}
+
+func TestJSONLog(t *testing.T) {
+	s, err := NewState(context.Background(), t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.CloseAndWait(new(strings.Builder))
+
+	jsonLog := new(bytes.Buffer)
+	e := NewEngine()
+	e.JSONLog = jsonLog
+	skipped := "[!GOOS:" + runtime.GOOS + "] echo skipped"
+	script := "# a comment\necho hello\n\n" + skipped + "\n## NOTE: a note\nretry echo again\n! echo unexpected\necho unreachable\n"
+	err = e.Execute(s, "test.txt", bufio.NewReader(strings.NewReader(script)), new(strings.Builder))
+	if err == nil {
+		t.Fatalf("Execute unexpectedly succeeded")
+	}
+
+	var got []CommandRecord
+	dec := json.NewDecoder(jsonLog)
+	for dec.More() {
+		var r CommandRecord
+		if err := dec.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		if r.Elapsed < 0 {
+			t.Errorf("record for %q has negative elapsed time %v", r.Command, r.Elapsed)
+		}
+		r.Elapsed = 0
+		got = append(got, r)
+	}
+	want := []CommandRecord{
+		{File: "test.txt", Line: 2, Command: "echo hello", CondsMet: true},
+		{File: "test.txt", Line: 4, Command: skipped},
+		{File: "test.txt", Line: 5, Command: "## NOTE: a note", Note: "a note"},
+		// A command run by another command is recorded before it.
+		{File: "test.txt", Line: 6, Command: "echo again", CondsMet: true},
+		{File: "test.txt", Line: 6, Command: "retry echo again", CondsMet: true},
+		{File: "test.txt", Line: 7, Command: "! echo unexpected", CondsMet: true, Error: "test.txt:7: echo unexpected: unexpected success"},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("JSONLog records:\n%+v\nwant:\n%+v", got, want)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewState(context.Background(), dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.CloseAndWait(new(strings.Builder))
+
+	e := NewEngine()
+	e.DryRun = true
+	script := "mkdir sub\n! exists sub\necho read-only\nstdout read-only\n"
+	log := new(strings.Builder)
+	if err := e.Execute(s, "test.txt", bufio.NewReader(strings.NewReader(script)), log); err != nil {
+		t.Fatalf("%v\n%s", err, log)
+	}
+	if !strings.Contains(log.String(), "> mkdir sub\n[dry run: command skipped]\n") {
+		t.Errorf("log does not mark mkdir as skipped:\n%s", log)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sub")); err == nil {
+		t.Errorf("mkdir created a directory in dry run")
+	}
+
+	// Unknown commands are still reported.
+	err = e.Execute(s, "test.txt", bufio.NewReader(strings.NewReader("mkdri sub\n")), log)
+	if err == nil || !strings.Contains(err.Error(), "unknown command") {
+		t.Errorf("misspelled command: %v; want unknown command", err)
+	}
+}
+
+func TestCommandsAndConditions(t *testing.T) {
+	e := NewEngine()
+
+	cmds := e.Commands()
+	var names []string
+	for name, usage := range cmds {
+		names = append(names, name)
+		if usage != e.Cmds[name].Usage() {
+			t.Errorf("Commands()[%q] is not the command's Usage", name)
+		}
+	}
+	sort.Strings(names)
+	want := make([]string, 0, len(e.Cmds))
+	for name := range e.Cmds {
+		want = append(want, name)
+	}
+	sort.Strings(want)
+	if !slices.Equal(names, want) {
+		t.Errorf("Commands() names:\n%q\nwant:\n%q", names, want)
+	}
+	if u := cmds["cmp"]; u == nil || u.Args == "" || u.Summary == "" {
+		t.Errorf("Commands()[cmp] = %+v; want a usage with Args and Summary", u)
+	}
+
+	conds := e.Conditions()
+	names = names[:0]
+	for name := range conds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	want = want[:0]
+	for name := range e.Conds {
+		want = append(want, name)
+	}
+	sort.Strings(want)
+	if !slices.Equal(names, want) {
+		t.Errorf("Conditions() names:\n%q\nwant:\n%q", names, want)
+	}
+	if u := conds["GOOS"]; u == nil || !u.Prefix {
+		t.Errorf("Conditions()[GOOS] = %+v; want a prefix condition", u)
+	}
+
+	// The maps are the caller's to modify.
+	delete(cmds, "cmp")
+	delete(conds, "GOOS")
+	if e.Cmds["cmp"] == nil || e.Conds["GOOS"] == nil {
+		t.Errorf("modifying the returned maps changed the Engine")
+	}
+}
+
+func TestUpdateGolden(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewState(context.Background(), dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.CloseAndWait(new(strings.Builder))
+
+	ar := &txtar.Archive{Files: []txtar.File{
+		{Name: "got.txt", Data: []byte("new\n")},
+		{Name: "want.txt", Data: []byte("old\n")},
+		{Name: "fail.txt", Data: []byte("old\n")},
+		{Name: "other.txt", Data: []byte("other\n")},
+	}}
+	if err := s.ExtractFiles(ar); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "outside.txt"), []byte("old\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	e := NewEngine()
+	e.UpdateGolden = true
+	script := "cmp got.txt want.txt\ncmp got.txt want.txt\n! cmp got.txt fail.txt\n! cmp got.txt outside.txt\n"
+	log := new(strings.Builder)
+	if err := e.Execute(s, "test.txt", bufio.NewReader(strings.NewReader(script)), log); err != nil {
+		t.Fatalf("%v\n%s", err, log)
+	}
+	if !strings.Contains(log.String(), "[updated want.txt]") {
+		t.Errorf("log does not report the update:\n%s", log)
+	}
+
+	// Only the archive file compared by a cmp expected to succeed is
+	// rewritten, both on disk and in the archive; files outside the archive
+	// and the other archive files are untouched.
+	if data, err := os.ReadFile(filepath.Join(dir, "want.txt")); err != nil || string(data) != "new\n" {
+		t.Errorf("want.txt on disk = %q, %v; want %q", data, err, "new\n")
+	}
+	for i, want := range []string{"new\n", "new\n", "old\n", "other\n"} {
+		if got := string(ar.Files[i].Data); got != want {
+			t.Errorf("archive file %s = %q; want %q", ar.Files[i].Name, got, want)
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "outside.txt")); err != nil || string(data) != "old\n" {
+		t.Errorf("outside.txt = %q, %v; want it unchanged", data, err)
+	}
+	if got := s.UpdatedFiles(); !slices.Equal(got, []string{"want.txt"}) {
+		t.Errorf("UpdatedFiles() = %q; want [want.txt]", got)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{"a.txt": "one\ntwo\n", "b.txt": "one\n2\n"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := NewState(context.Background(), dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.CloseAndWait(new(strings.Builder))
+
+	log := new(strings.Builder)
+	err = NewEngine().Execute(s, "test.txt", bufio.NewReader(strings.NewReader("diff a.txt b.txt\n")), log)
+	want := "test.txt:1: diff a.txt b.txt: a.txt and b.txt differ:\ndiff a.txt b.txt\n--- a.txt\n+++ b.txt\n@@ -1,2 +1,2 @@\n one\n-two\n+2"
+	if err == nil || err.Error() != want {
+		t.Errorf("diff reported error:\n%v\nwant:\n%s", err, want)
+	}
+	if got := s.Stdout(); !strings.HasPrefix(got, "diff a.txt b.txt\n") {
+		t.Errorf("diff wrote to stdout:\n%s", got)
+	}
+}
+
+func TestCommandHooks(t *testing.T) {
+	s, err := NewState(context.Background(), t.TempDir(), []string{"X=x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.CloseAndWait(new(strings.Builder))
+
+	var got []string
+	e := NewEngine()
+	e.BeforeCommand = func(s *State, cmd *CommandInfo) {
+		got = append(got, fmt.Sprintf("before %s:%d %s %q skipped=%v", cmd.File, cmd.Line, cmd.Name, cmd.Args, cmd.Skipped))
+	}
+	e.AfterCommand = func(s *State, cmd *CommandInfo, err error, elapsed time.Duration) {
+		if elapsed < 0 {
+			t.Errorf("%s: negative elapsed time %v", cmd.Name, elapsed)
+		}
+		got = append(got, fmt.Sprintf("after %s:%d %s err=%v", cmd.File, cmd.Line, cmd.Name, err))
+	}
+
+	script := "echo $X\n[!GOOS:" + runtime.GOOS + "] echo skipped\nrepeat 1\n\techo loop\nend\nretry echo again\nstop done\necho unreachable\n"
+	if err := e.Execute(s, "a.txt", bufio.NewReader(strings.NewReader(script)), new(strings.Builder)); err != nil {
+		t.Fatal(err)
+	}
+	err = e.Execute(s, "b.txt", bufio.NewReader(strings.NewReader("cat missing.txt\n")), new(strings.Builder))
+	if err == nil {
+		t.Fatalf("cat missing.txt succeeded")
+	}
+
+	want := []string{
+		`before a.txt:1 echo ["x"] skipped=false`,
+		`after a.txt:1 echo err=<nil>`,
+		// Commands whose conditions are not met are reported, but not run.
+		`before a.txt:2 echo [] skipped=true`,
+		`after a.txt:2 echo err=<nil>`,
+		// The commands in a block are reported, but not the block itself.
+		`before a.txt:4 echo ["loop"] skipped=false`,
+		`after a.txt:4 echo err=<nil>`,
+		// A command run by another command is reported within it.
+		`before a.txt:6 retry ["echo" "again"] skipped=false`,
+		`before a.txt:6 echo ["again"] skipped=false`,
+		`after a.txt:6 echo err=<nil>`,
+		`after a.txt:6 retry err=<nil>`,
+		// 'stop' is not an error.
+		`before a.txt:7 stop ["done"] skipped=false`,
+		`after a.txt:7 stop err=<nil>`,
+		`before b.txt:1 cat ["missing.txt"] skipped=false`,
+		`after b.txt:1 cat err=` + err.Error(),
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("hook calls:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestGrepNearMiss(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "f.txt"), []byte("one\ntwo\nhello world\nfour\nfive\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewState(context.Background(), dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.CloseAndWait(new(strings.Builder))
+
+	log := new(strings.Builder)
+	script := "! grep -B=1 -A=1 'hello.*gopher' f.txt\n! grep -A=1 'gopher' f.txt\n"
+	if err := NewEngine().Execute(s, "test.txt", bufio.NewReader(strings.NewReader(script)), log); err != nil {
+		t.Fatalf("%v\n%s", err, log)
+	}
+	for _, want := range []string{
+		"nearest partial match (line 3):\n  2: two\n> 3: hello world\n  4: four\n",
+		"> ! grep -A=1 'gopher' f.txt\nno partial match\n",
+	} {
+		if !strings.Contains(log.String(), want) {
+			t.Errorf("log does not contain:\n%s\nlog:\n%s", want, log)
+		}
+	}
+}
+
+func TestParseQuotes(t *testing.T) {
+	for _, tt := range []struct {
+		line    string
+		args    []string // unexpanded text of each argument
+		wantErr string
+	}{
+		{line: `echo a b`, args: []string{"a", "b"}},
+		{line: `echo 'a b' c`, args: []string{"a b", "c"}},
+		{line: `echo "a b" c`, args: []string{"a b", "c"}},
+		{line: `echo "a \"b\" \\ \$ \n" c`, args: []string{"a \"b\" \\ $ \n", "c"}},
+		{line: `echo "a\d"`, args: []string{`a\d`}},
+		{line: `echo a"b c"`, args: []string{`a"b`, `c"`}},
+		{line: `echo "a"'b'c`, args: []string{"abc"}},
+		{line: `echo "a#b" #c`, args: []string{"a#b"}},
+		{line: `echo 'a b`, wantErr: "unterminated quoted argument"},
+		{line: `echo "a b`, wantErr: "unterminated quoted argument"},
+		{line: `echo "a \"`, wantErr: "unterminated quoted argument"},
+	} {
+		cmd, err := parse("test", 1, tt.line)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("parse(%#q): error %v; want %q", tt.line, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parse(%#q): %v", tt.line, err)
+			continue
+		}
+		var args []string
+		for _, frags := range cmd.rawArgs {
+			var arg string
+			for _, f := range frags {
+				arg += f.s
+			}
+			args = append(args, arg)
+		}
+		if len(args) != len(tt.args) {
+			t.Errorf("parse(%#q): args %q; want %q", tt.line, args, tt.args)
+			continue
+		}
+		for i := range args {
+			if args[i] != tt.args[i] {
+				t.Errorf("parse(%#q): args %q; want %q", tt.line, args, tt.args)
+				break
+			}
+		}
+	}
+}
+
+func TestMaxOutputBytes(t *testing.T) {
+	testenv.MustHaveExec(t)
+	s, err := NewState(context.Background(), t.TempDir(), []string{"GO=" + testenv.GoToolPath(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.CloseAndWait(new(strings.Builder))
+
+	e := NewEngine()
+	e.MaxOutputBytes = 8
+	log := new(strings.Builder)
+	err = e.Execute(s, "test.txt", bufio.NewReader(strings.NewReader("exec $GO version\n")), log)
+	const want = "stdout truncated after reaching limit of 8 bytes (Engine.MaxOutputBytes)"
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("exec with long output: %v; want error containing %q", err, want)
+	}
+	if got := s.Stdout(); got != "go versi" {
+		t.Errorf("stdout = %q; want %q", got, "go versi")
+	}
+}
+
+func TestWaitTimeout(t *testing.T) {
+	s, err := NewState(context.Background(), t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.CloseAndWait(new(strings.Builder))
+
+	script := "sleep 1m &\nsleep -bg=long 2m\nwait -timeout=10ms\n"
+	log := new(strings.Builder)
+	start := time.Now()
+	err = NewEngine().Execute(s, "test.txt", bufio.NewReader(strings.NewReader(script)), log)
+	if elapsed := time.Since(start); elapsed > 30*time.Second {
+		t.Errorf("wait -timeout=10ms took %v", elapsed)
+	}
+	if err == nil {
+		t.Fatalf("wait -timeout succeeded with commands still running\n%s", log)
+	}
+	// Each command that was stopped is reported with its own line.
+	for _, want := range []string{
+		"test.txt:1: sleep 1m: still running after wait -timeout=10ms; stopped",
+		"test.txt:2: sleep 2m: still running after wait -timeout=10ms; stopped",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error does not report %q:\n%v", want, err)
+		}
+	}
+}
+
+func TestExecuteTimeout(t *testing.T) {
+	e := NewEngine()
+	e.Timeout = 50 * time.Millisecond
+
+	s, err := NewState(context.Background(), t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.CloseAndWait(new(strings.Builder))
+	ctx := s.Context()
+
+	script := "echo start\n? sleep 1m\necho unreachable\n"
+	log := new(strings.Builder)
+	err = e.Execute(s, "test.txt", bufio.NewReader(strings.NewReader(script)), log)
+	const want = "test.txt:2: sleep 1m: script did not complete within Engine.Timeout (50ms)"
+	if err == nil || err.Error() != want {
+		t.Fatalf("Execute: %v\nwant %s", err, want)
+	}
+	if strings.Contains(log.String(), "unreachable") {
+		t.Errorf("script continued after timeout:\n%s", log)
+	}
+	if s.Context() != ctx {
+		t.Errorf("State's Context was not restored")
+	}
+}
+
+func TestDefer(t *testing.T) {
+	e := NewEngine()
+	dir := t.TempDir()
+	s, err := NewState(context.Background(), dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	script := `
+defer echo first
+defer write done.txt 'done'
+defer cat missing.txt
+mkdir sub
+cd sub
+defer echo last
+! echo unexpected success
+echo unreachable
+`
+	log := new(strings.Builder)
+	err = e.Execute(s, "test.txt", bufio.NewReader(strings.NewReader(script)), log)
+	if err == nil {
+		t.Fatalf("Execute unexpectedly succeeded")
+	}
+	if err := s.CloseAndWait(log); err != nil {
+		t.Errorf("CloseAndWait: %v", err)
+	}
+
+	out := log.String()
+	t.Logf("log:\n%s", out)
+	if strings.Contains(out, "unreachable") {
+		t.Errorf("script continued after failure")
+	}
+	var order []string
+	for _, line := range strings.Split(out, "\n") {
+		if cmd, ok := strings.CutPrefix(line, "[deferred] "); ok {
+			order = append(order, cmd)
+		}
+	}
+	want := []string{"echo last", "cat missing.txt", "write done.txt done", "echo first"}
+	if strings.Join(order, "\n") != strings.Join(want, "\n") {
+		t.Errorf("deferred commands ran in order %q; want %q", order, want)
+	}
+	if !strings.Contains(out, "missing.txt: ") {
+		t.Errorf("error from deferred command was not logged")
+	}
+	// The deferred write ran in the directory that was current at the end of
+	// the script, and a failing deferred command did not stop later ones.
+	if _, err := os.Stat(filepath.Join(dir, "sub", "done.txt")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDeferEngine(t *testing.T) {
+	e := NewEngine()
+	e.Aliases = map[string]string{"hello": "echo hello"}
+	e.DryRun = true
+	var ran []string
+	e.BeforeCommand = func(s *State, cmd *CommandInfo) {
+		ran = append(ran, cmd.Name)
+	}
+	dir := t.TempDir()
+	s, err := NewState(context.Background(), dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	script := "defer hello\ndefer write done.txt done\n"
+	log := new(strings.Builder)
+	if err := e.Execute(s, "test.txt", bufio.NewReader(strings.NewReader(script)), log); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CloseAndWait(log); err != nil {
+		t.Errorf("CloseAndWait: %v", err)
+	}
+	out := log.String()
+	t.Logf("log:\n%s", out)
+
+	if want := []string{"defer", "defer", "write", "echo"}; !slices.Equal(ran, want) {
+		t.Errorf("BeforeCommand saw %q; want %q", ran, want)
+	}
+	if !strings.Contains(out, "[stdout]\nhello\n") {
+		t.Errorf("deferred alias did not run echo")
+	}
+	if !strings.Contains(out, "[dry run: command skipped]") {
+		t.Errorf("deferred write was not skipped")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "done.txt")); err == nil {
+		t.Errorf("deferred write ran in dry run")
+	}
+}
+
+func TestCmpIgnoreLinesUpdate(t *testing.T) {
+	e := NewEngine()
+	e.UpdateGolden = true
+	s, err := NewState(context.Background(), t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.CloseAndWait(new(strings.Builder))
+
+	ar := txtar.Parse([]byte("-- want.txt --\ntime: 0\nold\n"))
+	if err := s.ExtractFiles(ar); err != nil {
+		t.Fatal(err)
+	}
+	script := `
+write got.txt "time: 1\nnew\n"
+cmp -ignore-lines=^time: got.txt want.txt
+`
+	log := new(strings.Builder)
+	if err := e.Execute(s, "test.txt", bufio.NewReader(strings.NewReader(script)), log); err != nil {
+		t.Fatalf("%v\n%s", err, log)
+	}
+	// The update writes the actual contents, including the ignored line.
+	if got, want := string(ar.Files[0].Data), "time: 1\nnew\n"; got != want {
+		t.Errorf("updated want.txt = %q; want %q\n%s", got, want, log)
+	}
+}
+
+func TestCmpUpdateUnfiltered(t *testing.T) {
+	for _, tt := range []struct {
+		flag string
+		got  string
+		want string
+	}{
+		{"-trim", "\n  new\n\n", "old\n"},
+		{"-sort-lines", "b\na\n", "c\na\n"},
+	} {
+		t.Run(tt.flag, func(t *testing.T) {
+			e := NewEngine()
+			e.UpdateGolden = true
+			s, err := NewState(context.Background(), t.TempDir(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.CloseAndWait(new(strings.Builder))
+
+			ar := &txtar.Archive{Files: []txtar.File{
+				{Name: "got.txt", Data: []byte(tt.got)},
+				{Name: "want.txt", Data: []byte(tt.want)},
+			}}
+			if err := s.ExtractFiles(ar); err != nil {
+				t.Fatal(err)
+			}
+			script := "cmp " + tt.flag + " got.txt want.txt\n"
+			log := new(strings.Builder)
+			if err := e.Execute(s, "test.txt", bufio.NewReader(strings.NewReader(script)), log); err != nil {
+				t.Fatalf("%v\n%s", err, log)
+			}
+			// The update writes the actual contents, not the filtered ones.
+			if got := string(ar.Files[1].Data); got != tt.got {
+				t.Errorf("updated want.txt = %q; want %q\n%s", got, tt.got, log)
+			}
+		})
+	}
+}
+
+func TestRunScript(t *testing.T) {
+	e := NewEngine()
+	s, err := NewState(context.Background(), t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.CloseAndWait(new(strings.Builder))
+
+	log, err := e.RunScript(context.Background(), "ok.txt", []byte("echo hello\nstdout hello\n"), s)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, log)
+	}
+	if !strings.Contains(log, "> echo hello") {
+		t.Errorf("log does not show the script's commands:\n%s", log)
+	}
+
+	// Canceling ctx stops the running command, and the State's own Context
+	// is unaffected afterward.
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	log, err = e.RunScript(ctx, "cancel.txt", []byte("sleep 1m\necho unreachable\n"), s)
+	if err == nil {
+		t.Fatalf("script unexpectedly succeeded after ctx was canceled\n%s", log)
+	}
+	if !strings.HasPrefix(err.Error(), "cancel.txt:1: ") || strings.Contains(log, "unreachable") {
+		t.Errorf("unexpected error %v\n%s", err, log)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("error %v does not wrap %v", err, context.Canceled)
+	}
+	if s.Context().Err() != nil {
+		t.Errorf("State's Context is done after RunScript returned")
+	}
+}
+
+func TestAliases(t *testing.T) {
+	e := NewEngine()
+	e.Aliases = map[string]string{
+		"say":   "echo -n 'hello there'",
+		"greet": "say world",
+		"ls":    "ls -l", // not expanded again
+		"loop1": "loop2 x",
+		"loop2": "loop1 y",
+		"bad":   "! echo",
+	}
+
+	for _, tt := range []struct {
+		script  string
+		wantErr string
+	}{
+		{script: "say\nstdout '^hello there$'\n"},
+		{script: "greet again\nstdout '^hello there world again$'\n"},
+		{script: "! say\n", wantErr: "echo -n 'hello there': unexpected success"},
+		{script: "retry say\nstdout '^hello there$'\n"},
+		{script: "ls\n", wantErr: "ls -l: unknown command"},
+		{script: "loop1\n", wantErr: "loop1 y x: unknown command"},
+		{script: "bad\n", wantErr: "alias bad: expansion \"! echo\" is not a command"},
+	} {
+		s, err := NewState(context.Background(), t.TempDir(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		log := new(strings.Builder)
+		err = e.Execute(s, "test.txt", bufio.NewReader(strings.NewReader(tt.script)), log)
+		s.CloseAndWait(log)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%q: %v\n%s", tt.script, err, log)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%q: error %v; want %q", tt.script, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	dir := t.TempDir()
+	work := filepath.Join(dir, "work")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{work, outside} {
+		if err := os.Mkdir(d, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	hasSymlink := os.Symlink(outside, filepath.Join(work, "link")) == nil
+	if hasSymlink {
+		if err := os.Mkdir(filepath.Join(work, "nest"), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(outside, filepath.Join(work, "nest", "link")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	e := NewEngine()
+	e.Sandbox = true
+	for _, tt := range []struct {
+		script  string
+		symlink bool // the script requires work/link
+		wantErr string
+	}{
+		{script: "write a/b.txt hello\ncat a/b.txt\ncp a/b.txt c.txt\ncd a\ncd ..\nmkdir d\nrm c.txt\n"},
+		{script: "cat ../outside/secret.txt\n", wantErr: "path is outside the sandbox"},
+		{script: "cat " + filepath.Join(outside, "secret.txt") + "\n", wantErr: "path is outside the sandbox"},
+		{script: "cd ..\n", wantErr: "path is outside the sandbox"},
+		{script: "exists ../outside\n", wantErr: "path is outside the sandbox"},
+		{script: "cat link/secret.txt\n", symlink: true, wantErr: "path is outside the sandbox"},
+		{script: "write link/new.txt x\n", symlink: true, wantErr: "path is outside the sandbox"},
+		{script: "write src/link/new.txt x\ncp -r src/link .\n", symlink: true, wantErr: "path is outside the sandbox"},
+		{script: "write src/nest/link/new.txt x\ncp -r src/nest .\n", symlink: true, wantErr: "path is outside the sandbox"},
+		{script: "exec go version\n", wantErr: "programs are not allowed in the sandbox"},
+	} {
+		if tt.symlink && !hasSymlink {
+			continue
+		}
+		s, err := NewState(context.Background(), work, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		log := new(strings.Builder)
+		err = e.Execute(s, "test.txt", bufio.NewReader(strings.NewReader(tt.script)), log)
+		s.CloseAndWait(log)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%q: %v\n%s", tt.script, err, log)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%q: error %v; want %q", tt.script, err, tt.wantErr)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outside, "new.txt")); err == nil {
+		t.Errorf("write through symlink created a file outside the sandbox")
+	}
+
+	// Removing the symlink itself is allowed.
+	if hasSymlink {
+		s, err := NewState(context.Background(), work, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		log := new(strings.Builder)
+		if err := e.Execute(s, "test.txt", bufio.NewReader(strings.NewReader("rm link\n")), log); err != nil {
+			t.Errorf("rm link: %v\n%s", err, log)
+		}
+		s.CloseAndWait(log)
+		if _, err := os.Stat(filepath.Join(outside, "secret.txt")); err != nil {
+			t.Errorf("rm link removed the link's target: %v", err)
+		}
+	}
+}
+
+func TestMaxDiffLines(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{"got.txt": "a\nb\nc\n", "want.txt": "A\nB\nC\n"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := NewState(context.Background(), dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewEngine()
+	e.MaxDiffLines = 5
+	script := "! cmp got.txt want.txt\n! diff got.txt want.txt\ncp stdout got.diff\n"
+	log := new(strings.Builder)
+	if err := e.Execute(s, "test.txt", bufio.NewReader(strings.NewReader(script)), log); err != nil {
+		t.Fatalf("%v\n%s", err, log)
+	}
+	s.CloseAndWait(log)
+
+	// The diff logged by cmp is truncated to MaxDiffLines...
+	short := "diff got.txt want.txt\n--- got.txt\n+++ want.txt\n@@ -1,3 +1,3 @@\n-a\n... (5 more differences)\n"
+	if !strings.Contains(log.String(), "> ! cmp got.txt want.txt\n"+short) {
+		t.Errorf("log does not contain truncated cmp diff:\n%s\nlog:\n%s", short, log)
+	}
+
+	// ...as is the diff in the error reported by diff...
+	if want := "[got.txt and want.txt differ:\n" + strings.TrimSuffix(short, "\n") + "]\n"; !strings.Contains(log.String(), want) {
+		t.Errorf("log does not contain truncated diff error:\n%s\nlog:\n%s", want, log)
+	}
+
+	// ...but the output of diff is data, and is not.
+	full := "diff got.txt want.txt\n--- got.txt\n+++ want.txt\n@@ -1,3 +1,3 @@\n-a\n-b\n-c\n+A\n+B\n+C\n"
+	data, err := os.ReadFile(filepath.Join(dir, "got.diff"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != full {
+		t.Errorf("diff wrote:\n%s\nwant:\n%s", data, full)
+	}
+}
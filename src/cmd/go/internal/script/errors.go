@@ -52,11 +52,15 @@ type UsageError struct {
 
 func (e *UsageError) Error() string {
 	usage := e.Command.Usage()
+	args := usage.Args
+	if args != "" {
+		args = " " + args
+	}
 	suffix := ""
 	if usage.Async {
 		suffix = " [&]"
 	}
-	return fmt.Sprintf("usage: %s %s%s", e.Name, usage.Args, suffix)
+	return fmt.Sprintf("usage: %s%s%s", e.Name, args, suffix)
 }
 
 // ErrUsage may be returned by a Command to indicate that it was called with
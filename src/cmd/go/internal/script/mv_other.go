@@ -0,0 +1,15 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !unix && !windows
+
+package script
+
+// isCrossDevice reports whether err indicates that a rename failed because
+// the source and destination are on different file systems. On this platform
+// such failures cannot be distinguished from others, so it always reports
+// false.
+func isCrossDevice(err error) bool {
+	return false
+}
@@ -0,0 +1,18 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package script
+
+import (
+	"errors"
+	"syscall"
+)
+
+const _ERROR_NOT_SAME_DEVICE = syscall.Errno(17)
+
+// isCrossDevice reports whether err indicates that a rename failed because
+// the source and destination are on different volumes.
+func isCrossDevice(err error) bool {
+	return errors.Is(err, _ERROR_NOT_SAME_DEVICE)
+}
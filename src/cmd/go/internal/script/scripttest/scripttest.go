@@ -7,21 +7,41 @@ package scripttest
 
 import (
 	"bufio"
+	"bytes"
+	"cmd/go/internal/imports"
 	"cmd/go/internal/script"
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"internal/testenv"
+	"internal/txtar"
 	"io"
+	"io/fs"
+	"math/big"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 // DefaultCmds returns a set of broadly useful script commands.
 //
 // This set includes all of the commands in script.DefaultCmds,
 // as well as a "skip" command that halts the script and causes the
-// testing.TB passed to Run to be skipped.
+// testing.TB passed to Run to be skipped, a "cmpjson" command
+// that compares JSON documents structurally, and a "jsonpath" command
+// that extracts a value from a JSON document.
 func DefaultCmds() map[string]script.Cmd {
 	cmds := script.DefaultCmds()
+	cmds["cmpjson"] = CmpJSON()
+	cmds["jsonpath"] = JSONPath()
 	cmds["skip"] = Skip()
 	return cmds
 }
@@ -31,23 +51,60 @@ func DefaultCmds() map[string]script.Cmd {
 // This set includes all of the conditions in script.DefaultConds,
 // as well as:
 //
-//   - Conditions of the form "exec:foo" are active when the executable "foo" is
-//     found in the test process's PATH, and inactive when the executable is
-//     not found.
+//   - Conditions of the form "env:NAME" are active when the script
+//     environment variable NAME is set, and those of the form "env:NAME:op:value"
+//     are active when its value matches value according to op (see EnvMatch).
+//
+//   - "posix", "unix", and "windows" are active when the script's target GOOS
+//     (its GOOS environment variable, or runtime.GOOS if that is unset) is,
+//     respectively, one matched by the "unix" build constraint or "zos",
+//     one matched by the "unix" build constraint, or "windows".
 //
 //   - "short" is active when testing.Short() is true.
 //
+//   - "symlink" is active when the platform supports symlinks, and conditions
+//     of the form "symlink:path" are active when path names a symlink
+//     (see SymlinkCond).
+//
 //   - "verbose" is active when testing.Verbose() is true.
 func DefaultConds() map[string]script.Cond {
 	conds := script.DefaultConds()
-	conds["exec"] = CachedExec()
+	conds["env"] = EnvMatch()
+	conds["posix"] = goosCond("GOOS is a POSIX-like system (unix or zos)", func(goos string) bool {
+		return imports.UnixOS[goos] || goos == "zos"
+	})
 	conds["short"] = script.BoolCondition("testing.Short()", testing.Short())
+	conds["symlink"] = SymlinkCond()
+	conds["unix"] = goosCond("GOOS matches the unix build constraint", func(goos string) bool {
+		return imports.UnixOS[goos]
+	})
 	conds["verbose"] = script.BoolCondition("testing.Verbose()", testing.Verbose())
+	conds["windows"] = goosCond("GOOS == windows", func(goos string) bool {
+		return goos == "windows"
+	})
 	return conds
 }
 
+// goosCond returns a Condition that reports whether match accepts the
+// script's target GOOS: the value of its GOOS environment variable, which may
+// differ from runtime.GOOS when the script cross-compiles, or runtime.GOOS if
+// that variable is unset or empty.
+func goosCond(summary string, match func(goos string) bool) script.Cond {
+	return script.Condition(summary, func(s *script.State) (bool, error) {
+		goos, _ := s.LookupEnv("GOOS")
+		if goos == "" {
+			goos = runtime.GOOS
+		}
+		return match(goos), nil
+	})
+}
+
 // Run runs the script from the given filename starting at the given initial state.
 // When the script completes, Run closes the state.
+//
+// To keep one slow or hung script from consuming the whole 'go test -timeout'
+// budget, set e.Timeout: a script that runs longer than that fails, reporting
+// the command it was running, while the remaining tests continue to run.
 func Run(t testing.TB, e *script.Engine, s *script.State, filename string, testScript io.Reader) {
 	t.Helper()
 	err := func() (err error) {
@@ -70,20 +127,7 @@ func Run(t testing.TB, e *script.Engine, s *script.State, filename string, testS
 		}()
 
 		if testing.Verbose() {
-			// Add the environment to the start of the script log.
-			wait, err := script.Env().Run(s)
-			if err != nil {
-				t.Fatal(err)
-			}
-			if wait != nil {
-				stdout, stderr, err := wait(s)
-				if err != nil {
-					t.Fatalf("env: %v\n%s", err, stderr)
-				}
-				if len(stdout) > 0 {
-					s.Logf("%s\n", stdout)
-				}
-			}
+			logEnv(t, s)
 		}
 
 		return e.Execute(s, filename, bufio.NewReader(testScript), log)
@@ -101,12 +145,215 @@ func Run(t testing.TB, e *script.Engine, s *script.State, filename string, testS
 	}
 }
 
+// logEnv adds the environment of s to the start of the script log.
+func logEnv(t testing.TB, s *script.State) {
+	t.Helper()
+	wait, err := script.Env().Run(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait != nil {
+		stdout, stderr, err := wait(s)
+		if err != nil {
+			t.Fatalf("env: %v\n%s", err, stderr)
+		}
+		if len(stdout) > 0 {
+			s.Logf("%s\n", stdout)
+		}
+	}
+}
+
+// RunSections is like Run, but reports each section of the script that begins
+// with a marker line of the form "# ---name" as a subtest of t with that name.
+//
+// The sections run in order and share s. Any lines before the first marker
+// run as part of t itself. Since later sections may depend on the state left
+// by earlier ones, a section that fails (or that ends the script with 'skip' or
+// 'stop') causes the remaining sections not to run. Error messages and logs
+// refer to lines of the complete script.
+func RunSections(t *testing.T, e *script.Engine, s *script.State, filename string, testScript io.Reader) {
+	t.Helper()
+	text, err := io.ReadAll(testScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Detect a 'stop' command, which ends the script but not the section
+	// containing it, so that the remaining sections can be skipped.
+	stopped := false
+	se := *e
+	se.AfterCommand = func(s *script.State, cmd *script.CommandInfo, err error, elapsed time.Duration) {
+		if e.AfterCommand != nil {
+			e.AfterCommand(s, cmd, err, elapsed)
+		}
+		if cmd.Name == "stop" && !cmd.Skipped && err == nil {
+			stopped = true
+		}
+	}
+
+	log := new(strings.Builder)
+	log.WriteString("\n") // Start output on a new line for consistent indentation.
+	defer func() {
+		t.Helper()
+		if err := s.CloseAndWait(log); err != nil {
+			t.Errorf("FAIL: %v", err)
+		}
+		if log.Len() > 1 {
+			t.Log(strings.TrimSuffix(log.String(), "\n"))
+		}
+	}()
+	if testing.Verbose() {
+		logEnv(t, s)
+	}
+
+	// run runs the lines of text starting at the given line number, preceded
+	// by blank lines so that line numbers match those of the whole script.
+	run := func(t testing.TB, log *strings.Builder, start int, lines []string) (ok bool) {
+		t.Helper()
+		src := strings.Repeat("\n", start-1) + strings.Join(lines, "\n")
+		err := se.Execute(s, filename, bufio.NewReader(strings.NewReader(src)), log)
+		if skip := (skipError{}); errors.As(err, &skip) {
+			stopped = true
+			if log.Len() > 0 {
+				t.Log(strings.TrimSuffix(log.String(), "\n"))
+				log.Reset()
+			}
+			if skip.msg == "" {
+				t.Skip("SKIP")
+			}
+			t.Skipf("SKIP: %v", skip.msg)
+		}
+		if err != nil {
+			t.Errorf("FAIL: %v", err)
+			return false
+		}
+		return !stopped
+	}
+
+	lines := strings.Split(string(text), "\n")
+	sections := markerSections(lines)
+	end := len(lines)
+	if len(sections) > 0 {
+		end = sections[0].line - 1
+	}
+	if !run(t, log, 1, lines[:end]) {
+		return
+	}
+
+	for i, sec := range sections {
+		end := len(lines)
+		if i+1 < len(sections) {
+			end = sections[i+1].line - 1
+		}
+		ok := t.Run(sec.title, func(t *testing.T) {
+			t.Helper()
+			log := new(strings.Builder)
+			log.WriteString("\n")
+			defer func() {
+				if log.Len() > 1 {
+					t.Log(strings.TrimSuffix(log.String(), "\n"))
+				}
+			}()
+			run(t, log, sec.line, lines[sec.line-1:end])
+		})
+		if !ok || stopped {
+			return
+		}
+	}
+}
+
+// A section is a titled part of a script.
+type section struct {
+	line  int    // line number of the line that begins the section
+	title string // title of the section, from that line
+}
+
+// markerSections returns the sections of a script, given as lines, that
+// begin with a "# ---name" marker line, in order.
+func markerSections(lines []string) []section {
+	var sections []section
+	for i, line := range lines {
+		name, ok := strings.CutPrefix(line, "# ---")
+		if !ok {
+			continue
+		}
+		sections = append(sections, section{line: i + 1, title: strings.TrimSpace(name)})
+	}
+	return sections
+}
+
+// RunDir runs each script matching dir/*.txt as a parallel subtest of t,
+// named after the script's file without the ".txt" extension.
+//
+// Each script is parsed as a txtar archive and run by e in a fresh State
+// whose working directory is a new temporary directory containing the
+// archive's files, and whose initial environment is env (or os.Environ(),
+// if env is nil).
+//
+// If the first line of a script is "# skip", optionally followed by a reason,
+// the subtest is skipped without running the script.
+func RunDir(t *testing.T, e *script.Engine, env []string, dir string) {
+	t.Helper()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		file := file
+		name := strings.TrimSuffix(filepath.Base(file), ".txt")
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			a, err := txtar.ParseFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reason, ok := skipDirective(a.Comment); ok {
+				if reason == "" {
+					t.Skip("SKIP")
+				}
+				t.Skipf("SKIP: %s", reason)
+			}
+
+			ctx := context.Background()
+			if deadline, ok := t.Deadline(); ok {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithDeadline(ctx, deadline)
+				defer cancel()
+			}
+			s, err := script.NewState(ctx, t.TempDir(), env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.ExtractFiles(a); err != nil {
+				t.Fatal(err)
+			}
+			Run(t, e, s, filepath.Base(file), bytes.NewReader(a.Comment))
+		})
+	}
+}
+
+// skipDirective reports whether the first line of script is a "# skip"
+// directive, and if so returns the reason that follows it (if any).
+func skipDirective(script []byte) (reason string, ok bool) {
+	line, _, _ := bytes.Cut(script, []byte("\n"))
+	rest, ok := strings.CutPrefix(strings.TrimSpace(string(line)), "# skip")
+	if !ok || (rest != "" && rest[0] != ' ' && rest[0] != '\t') {
+		return "", false
+	}
+	return strings.TrimSpace(rest), true
+}
+
 // Skip returns a sentinel error that causes Run to mark the test as skipped.
 func Skip() script.Cmd {
 	return script.Command(
 		script.CmdUsage{
 			Summary: "skip the current test",
 			Args:    "[msg]",
+			Detail: []string{
+				"Execution of the script halts, and Run reports the test as skipped (with msg, if any) rather than failed.",
+			},
 		},
 		func(_ *script.State, args ...string) (script.WaitFunc, error) {
 			if len(args) > 1 {
@@ -132,7 +379,8 @@ func (s skipError) Error() string {
 
 // CachedExec returns a Condition that reports whether the PATH of the test
 // binary itself (not the script's current environment) contains the named
-// executable.
+// executable. Unlike the "exec" condition in script.DefaultConds, its results
+// are shared by all scripts.
 func CachedExec() script.Cond {
 	return script.CachedCondition(
 		"<suffix> names an executable in the test binary's PATH",
@@ -141,3 +389,375 @@ func CachedExec() script.Cond {
 			return err == nil, nil
 		})
 }
+
+// CmpJSON returns a Cmd that compares the JSON values encoded in two files,
+// ignoring formatting and the order of object keys.
+func CmpJSON() script.Cmd {
+	return script.Command(
+		script.CmdUsage{
+			Summary: "compare JSON files for semantic differences",
+			Args:    "[-q] file1 file2",
+			Detail: []string{
+				"By convention, file1 is the actual data and file2 is the expected data.",
+				"The command succeeds if both files decode to the same JSON value, regardless of whitespace or the order of object keys. Numbers are compared exactly by value, so 1 and 1.0 are equal but no two different integers are, however large.",
+				"File1 can be 'stdout' or 'stderr' to compare the stdout or stderr buffer from the most recent command.",
+				"On mismatch, the path of the first differing value is printed to the log unless -q is given.",
+				"As with cmp, if the engine's UpdateGolden mode is set, a mismatched file2 from the script's archive is rewritten with the contents of file1.",
+			},
+			ReadOnly: true,
+		},
+		func(s *script.State, args ...string) (script.WaitFunc, error) {
+			quiet := false
+			args, err := script.ParseFlags(args, func(flag string) (bool, error) {
+				if flag != "-q" {
+					return false, nil
+				}
+				quiet = true
+				return true, nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			if len(args) != 2 {
+				return nil, script.ErrUsage
+			}
+
+			name1, name2 := args[0], args[1]
+			var data1 []byte
+			switch name1 {
+			case "stdout":
+				data1 = []byte(s.Stdout())
+			case "stderr":
+				data1 = []byte(s.Stderr())
+			default:
+				var err error
+				data1, err = s.ReadFile(name1)
+				if err != nil {
+					return nil, err
+				}
+			}
+			data2, err := s.ReadFile(name2)
+			if err != nil {
+				return nil, err
+			}
+
+			v1, err := decodeJSON(data1)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name1, err)
+			}
+			v2, err := decodeJSON(data2)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name2, err)
+			}
+
+			if d := jsonDiff("", v1, v2); d != "" {
+				if !quiet {
+					s.Logf("%s\n", d)
+				}
+				return nil, script.NewMismatchError(s, name1, name2, data1)
+			}
+			return nil, nil
+		})
+}
+
+// decodeJSON decodes the JSON value in data, keeping numbers as json.Number
+// so that they can be compared exactly.
+func decodeJSON(data []byte) (any, error) {
+	var v any
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("invalid data after top-level value")
+	}
+	return v, nil
+}
+
+// JSONPath sets an environment variable to a value extracted from a JSON
+// document.
+func JSONPath() script.Cmd {
+	return script.Command(
+		script.CmdUsage{
+			Summary: "set a variable to a value within a JSON file",
+			Args:    "var path file",
+			Detail: []string{
+				"The path is a sequence of object keys, each preceded by '.', and array indices in brackets, as in '.items[0].id'. The path '.' denotes the whole document.",
+				"File can be 'stdout' or 'stderr' to use the stdout or stderr buffer from the most recent command.",
+				"If the value is a string, var is set to the string itself; otherwise, var is set to the compact JSON encoding of the value.",
+				"It is an error if the document contains no value at the path.",
+			},
+			ReadOnly: true,
+		},
+		func(s *script.State, args ...string) (script.WaitFunc, error) {
+			if len(args) != 3 {
+				return nil, script.ErrUsage
+			}
+			name, path, file := args[0], args[1], args[2]
+
+			var data []byte
+			switch file {
+			case "stdout":
+				data = []byte(s.Stdout())
+			case "stderr":
+				data = []byte(s.Stderr())
+			default:
+				var err error
+				data, err = s.ReadFile(file)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			// Decode numbers as json.Number so that they are reported exactly
+			// as they appear in the document.
+			var v any
+			dec := json.NewDecoder(bytes.NewReader(data))
+			dec.UseNumber()
+			if err := dec.Decode(&v); err != nil {
+				return nil, fmt.Errorf("%s: %w", file, err)
+			}
+
+			v, err := jsonLookup(v, path)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", file, err)
+			}
+			if str, ok := v.(string); ok {
+				return nil, s.Setenv(name, str)
+			}
+			return nil, s.Setenv(name, jsonString(v))
+		})
+}
+
+// jsonLookup returns the value at path within the decoded JSON value v.
+func jsonLookup(v any, path string) (any, error) {
+	if path == "." {
+		return v, nil
+	}
+	if path == "" {
+		return nil, errors.New("empty path")
+	}
+
+	at := "" // the part of path consumed so far
+	for rest := path; rest != ""; {
+		switch rest[0] {
+		case '.':
+			i := strings.IndexAny(rest[1:], ".[") + 1
+			if i == 0 {
+				i = len(rest)
+			}
+			key := rest[1:i]
+			if key == "" {
+				return nil, fmt.Errorf("malformed path %q: empty key after %q", path, at)
+			}
+			m, ok := v.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("no value at %s%s: %s is not an object", at, rest[:i], jsonAt(at))
+			}
+			if v, ok = m[key]; !ok {
+				return nil, fmt.Errorf("no value at %s%s", at, rest[:i])
+			}
+			at, rest = at+rest[:i], rest[i:]
+
+		case '[':
+			i := strings.Index(rest, "]")
+			if i < 0 {
+				return nil, fmt.Errorf("malformed path %q: missing ']'", path)
+			}
+			n, err := strconv.Atoi(rest[1:i])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("malformed path %q: bad index %q", path, rest[1:i])
+			}
+			a, ok := v.([]any)
+			if !ok {
+				return nil, fmt.Errorf("no value at %s%s: %s is not an array", at, rest[:i+1], jsonAt(at))
+			}
+			if n >= len(a) {
+				return nil, fmt.Errorf("no value at %s%s: array length is %d", at, rest[:i+1], len(a))
+			}
+			v = a[n]
+			at, rest = at+rest[:i+1], rest[i+1:]
+
+		default:
+			return nil, fmt.Errorf("malformed path %q: want '.' or '[' after %q", path, at)
+		}
+	}
+	return v, nil
+}
+
+// jsonAt returns path, or "." if path refers to the whole document.
+func jsonAt(path string) string {
+	if path == "" {
+		return "."
+	}
+	return path
+}
+
+// jsonDiff returns a description of the first difference between the decoded
+// JSON values v1 and v2, or the empty string if they are equal.
+// path is the location of v1 and v2 within their enclosing documents.
+func jsonDiff(path string, v1, v2 any) string {
+	at := path
+	if at == "" {
+		at = "."
+	}
+
+	switch x1 := v1.(type) {
+	case map[string]any:
+		x2, ok := v2.(map[string]any)
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(x1)+len(x2))
+		for k := range x1 {
+			keys = append(keys, k)
+		}
+		for k := range x2 {
+			if _, ok := x1[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			e1, ok1 := x1[k]
+			e2, ok2 := x2[k]
+			switch {
+			case !ok1:
+				return fmt.Sprintf("%s.%s: missing from file1", path, k)
+			case !ok2:
+				return fmt.Sprintf("%s.%s: missing from file2", path, k)
+			}
+			if d := jsonDiff(path+"."+k, e1, e2); d != "" {
+				return d
+			}
+		}
+		return ""
+
+	case []any:
+		x2, ok := v2.([]any)
+		if !ok {
+			break
+		}
+		for i := 0; i < len(x1) && i < len(x2); i++ {
+			if d := jsonDiff(fmt.Sprintf("%s[%d]", path, i), x1[i], x2[i]); d != "" {
+				return d
+			}
+		}
+		if len(x1) != len(x2) {
+			return fmt.Sprintf("%s: array length %d != %d", at, len(x1), len(x2))
+		}
+		return ""
+
+	case json.Number:
+		x2, ok := v2.(json.Number)
+		if !ok {
+			break
+		}
+		// Compare the numbers exactly, so that integers too large to be
+		// represented by a float64 cannot round to the same value.
+		r1, ok1 := new(big.Rat).SetString(string(x1))
+		r2, ok2 := new(big.Rat).SetString(string(x2))
+		if ok1 && ok2 && r1.Cmp(r2) == 0 {
+			return ""
+		}
+
+	default:
+		if v1 == v2 {
+			return ""
+		}
+	}
+
+	return fmt.Sprintf("%s: %s != %s", at, jsonString(v1), jsonString(v2))
+}
+
+// jsonString returns the compact JSON encoding of v, for use in diagnostics.
+func jsonString(v any) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// SymlinkCond returns a Condition that reports whether the platform supports
+// symlinks or, given a suffix, whether the suffix names a symlink.
+//
+// Without a suffix, the condition is active if testenv.HasSymlink reports
+// true. With a suffix, the suffix is expanded and interpreted relative to the
+// script's working directory. Since a path cannot be a symlink on a platform
+// that does not support them, scripts that check "symlink:path" should first
+// skip if "symlink" is not active.
+func SymlinkCond() script.Cond {
+	return &symlinkCond{
+		usage: script.CondUsage{
+			Summary:        "the platform supports symlinks, or <suffix> names a symlink (after environment expansion)",
+			Prefix:         true,
+			OptionalSuffix: true,
+		},
+	}
+}
+
+type symlinkCond struct {
+	usage script.CondUsage
+}
+
+func (c *symlinkCond) Usage() *script.CondUsage { return &c.usage }
+
+func (c *symlinkCond) Eval(s *script.State, suffix string) (bool, error) {
+	if suffix == "" {
+		return testenv.HasSymlink(), nil
+	}
+	info, err := os.Lstat(s.Path(s.ExpandEnv(suffix, false)))
+	return err == nil && info.Mode()&fs.ModeSymlink != 0, nil
+}
+
+// EnvMatch returns a Condition that reports whether a variable in the script
+// environment is set, or whether its value matches an operand.
+//
+// The suffix has the form "NAME" or "NAME:op:operand", where op is one of
+// "eq" (the value equals operand), "contains" (the value contains operand),
+// "prefix" (the value begins with operand), or "regexp" (the value matches the
+// regular expression operand). A condition with an operator is inactive if the
+// variable is not set. Since conditions are not subject to quoting or
+// expansion, the operand cannot contain spaces or "|".
+func EnvMatch() script.Cond {
+	return script.PrefixCondition(
+		"<suffix> is NAME (NAME is set) or NAME:op:operand, with op one of eq, contains, prefix, or regexp",
+		func(s *script.State, suffix string) (bool, error) {
+			name, rest, hasOp := strings.Cut(suffix, ":")
+			if name == "" {
+				return false, errors.New("missing variable name")
+			}
+			v, ok := s.LookupEnv(name)
+			if !hasOp {
+				return ok, nil
+			}
+
+			op, operand, ok2 := strings.Cut(rest, ":")
+			if !ok2 {
+				return false, fmt.Errorf("malformed suffix %q: want NAME:op:operand", suffix)
+			}
+			var match func() (bool, error)
+			switch op {
+			case "eq":
+				match = func() (bool, error) { return v == operand, nil }
+			case "contains":
+				match = func() (bool, error) { return strings.Contains(v, operand), nil }
+			case "prefix":
+				match = func() (bool, error) { return strings.HasPrefix(v, operand), nil }
+			case "regexp":
+				re, err := regexp.Compile(operand)
+				if err != nil {
+					return false, err
+				}
+				match = func() (bool, error) { return re.MatchString(v), nil }
+			default:
+				return false, fmt.Errorf("unknown operator %q", op)
+			}
+			if !ok {
+				return false, nil
+			}
+			return match()
+		})
+}
@@ -0,0 +1,165 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scripttest
+
+import (
+	"bufio"
+	"cmd/go/internal/script"
+	"context"
+	"fmt"
+	"internal/testenv"
+	"internal/txtar"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCmpJSONUpdate(t *testing.T) {
+	e := script.NewEngine()
+	e.Cmds["cmpjson"] = CmpJSON()
+	e.UpdateGolden = true
+	s, err := script.NewState(context.Background(), t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.CloseAndWait(new(strings.Builder))
+
+	ar := txtar.Parse([]byte("-- want.json --\n{\"n\": 1}\n-- same.json --\n{\"n\": 2.0}\n"))
+	if err := s.ExtractFiles(ar); err != nil {
+		t.Fatal(err)
+	}
+	script := "echo '{\"n\": 2}'\ncmpjson stdout want.json\ncmpjson stdout same.json\n"
+	log := new(strings.Builder)
+	if err := e.Execute(s, "test.txt", bufio.NewReader(strings.NewReader(script)), log); err != nil {
+		t.Fatalf("%v\n%s", err, log)
+	}
+	// Only the file that differs is rewritten.
+	if got, want := string(ar.Files[0].Data), "{\"n\": 2}\n"; got != want {
+		t.Errorf("updated want.json = %q; want %q\n%s", got, want, log)
+	}
+	if got, want := s.UpdatedFiles(), []string{"want.json"}; !slices.Equal(got, want) {
+		t.Errorf("UpdatedFiles() = %q; want %q", got, want)
+	}
+}
+
+func TestRunDir(t *testing.T) {
+	dir := t.TempDir()
+	for name, text := range map[string]string{
+		"a.txt":    "exists f.txt\nenv FROM_ENV\nstdout '^FROM_ENV=1$'\n-- f.txt --\n-- a-only.txt --\n",
+		"b.txt":    "cp f.txt g.txt\n! exists a-only.txt\n-- f.txt --\n",
+		"skip.txt": "# skip not today\nexec false\n",
+		"other.md": "exec false\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var (
+		mu  sync.Mutex
+		ran []string
+	)
+	e := script.NewEngine()
+	e.BeforeCommand = func(_ *script.State, cmd *script.CommandInfo) {
+		mu.Lock()
+		defer mu.Unlock()
+		ran = append(ran, cmd.File+":"+cmd.Name)
+	}
+	t.Run("dir", func(t *testing.T) {
+		RunDir(t, e, []string{"FROM_ENV=1"}, dir)
+	})
+	// Each script ran in its own directory (so b.txt does not see a.txt's
+	// archive), while the skipped script and the non-script file did not run.
+	sort.Strings(ran)
+	want := []string{"a.txt:env", "a.txt:exists", "a.txt:stdout", "b.txt:cp", "b.txt:exists"}
+	if !slices.Equal(ran, want) {
+		t.Errorf("ran %q; want %q", ran, want)
+	}
+}
+
+func TestRunSections(t *testing.T) {
+	const text = `env A=1
+# ---first
+env B=$A
+# ---second
+[env:B:eq:1] env C=$B
+stop
+# ---third
+env D=1
+`
+	s, err := script.NewState(context.Background(), t.TempDir(), []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := script.NewEngine()
+	e.Conds["env"] = EnvMatch()
+
+	var lines []int
+	e.BeforeCommand = func(_ *script.State, cmd *script.CommandInfo) {
+		lines = append(lines, cmd.Line)
+	}
+	RunSections(t, e, s, "test.txt", strings.NewReader(text))
+
+	// Each section shares the state left by the previous one, and 'stop' keeps
+	// the remaining sections from running.
+	if v, _ := s.LookupEnv("C"); v != "1" {
+		t.Errorf("C = %q; want 1", v)
+	}
+	if _, ok := s.LookupEnv("D"); ok {
+		t.Errorf("section after 'stop' was run")
+	}
+	if got, want := fmt.Sprint(lines), "[1 3 5 6]"; got != want {
+		t.Errorf("ran lines %s; want %s", got, want)
+	}
+}
+
+func TestRunSectionsFailure(t *testing.T) {
+	if os.Getenv("GO_SCRIPTTEST_SECTIONS_HELPER") == "1" {
+		const text = `# ---first
+env A=1
+# ---second
+! env A
+# ---third
+env B=1
+`
+		s, err := script.NewState(context.Background(), t.TempDir(), []string{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := script.NewEngine()
+		e.BeforeCommand = func(_ *script.State, cmd *script.CommandInfo) {
+			fmt.Printf("running line %d\n", cmd.Line)
+		}
+		RunSections(t, e, s, "test.txt", strings.NewReader(text))
+		return
+	}
+
+	// The failing section fails the test, so run it in a subprocess.
+	testenv.MustHaveExec(t)
+	exe, err := os.Executable()
+	if err != nil {
+		t.Skipf("os.Executable: %v", err)
+	}
+	cmd := testenv.Command(t, exe, "-test.run=^TestRunSectionsFailure$", "-test.v")
+	cmd.Env = append(cmd.Environ(), "GO_SCRIPTTEST_SECTIONS_HELPER=1")
+	out, err := cmd.CombinedOutput()
+	t.Logf("%s", out)
+	if err == nil {
+		t.Fatalf("script with a failing section passed")
+	}
+	for _, want := range []string{"running line 2\n", "running line 4\n", "--- PASS: TestRunSectionsFailure/first", "--- FAIL: TestRunSectionsFailure/second"} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("output does not contain %q", want)
+		}
+	}
+	// A failing section keeps the sections after it from running.
+	if strings.Contains(string(out), "running line 6") || strings.Contains(string(out), "TestRunSectionsFailure/third") {
+		t.Errorf("section after a failure was run")
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scripttest
+
+import (
+	"bufio"
+	"bytes"
+	"cmd/go/internal/script"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A TAP runs scripts and reports their results to an io.Writer in the
+// format of the Test Anything Protocol (version 14), for use by external
+// test harnesses that consume TAP rather than the output of 'go test'.
+//
+// Each script run by the TAP's Run method is reported as a single test point
+// named after the script file. If the script is divided into sections, each
+// section is also reported as a test point of a subtest for that script.
+// A failing test point is followed by a YAML diagnostic block containing the
+// error and, for the script's own test point, the script log.
+//
+// A TAP may be used from multiple goroutines at once: the output for each
+// script is written only once the script has completed.
+type TAP struct {
+	mu  sync.Mutex
+	w   io.Writer
+	n   int  // number of test points written
+	hdr bool // whether the version line has been written
+	err error
+}
+
+// NewTAP returns a TAP that writes its report to w.
+// The caller must call Close after the last script has been run.
+func NewTAP(w io.Writer) *TAP {
+	return &TAP{w: w}
+}
+
+// Run runs the script from the given filename starting at the given initial
+// state, and reports the result as the next test point in tap's output.
+// When the script completes, Run closes the state.
+//
+// Run returns the error that caused the script to fail, or nil if it
+// succeeded or was skipped.
+func (tap *TAP) Run(e *script.Engine, s *script.State, filename string, testScript io.Reader) error {
+	text, err := io.ReadAll(testScript)
+	if err != nil {
+		return err
+	}
+	sections := scriptSections(text)
+
+	// Track the last line of the script itself (rather than of any file that
+	// it includes) that was reached, so that we can tell which sections ran.
+	lastLine := 0
+	te := *e
+	te.BeforeCommand = func(s *script.State, cmd *script.CommandInfo) {
+		if e.BeforeCommand != nil {
+			e.BeforeCommand(s, cmd)
+		}
+		if cmd.File == filename {
+			lastLine = cmd.Line
+		}
+	}
+
+	log := new(strings.Builder)
+	err = te.Execute(s, filename, bufio.NewReader(bytes.NewReader(text)), log)
+	if closeErr := s.CloseAndWait(log); err == nil {
+		err = closeErr
+	}
+
+	var cmdErr *script.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.File == filename {
+		lastLine = cmdErr.Line
+	}
+	skip, skipped := "", false
+	if se := (skipError{}); errors.As(err, &se) {
+		skip, skipped = se.msg, true
+		err = nil
+	}
+
+	var b strings.Builder
+	if len(sections) > 0 {
+		fmt.Fprintf(&b, "# Subtest: %s\n", filename)
+		for i, sec := range sections {
+			reached := sec.line <= lastLine
+			failed := err != nil && reached && (i+1 == len(sections) || lastLine < sections[i+1].line)
+			switch {
+			case failed:
+				fmt.Fprintf(&b, "    not ok %d - %s\n", i+1, sec.title)
+				writeTAPDiag(&b, "      ", err, "")
+			case !reached && (err != nil || skipped):
+				fmt.Fprintf(&b, "    ok %d - %s # SKIP not reached\n", i+1, sec.title)
+			default:
+				fmt.Fprintf(&b, "    ok %d - %s\n", i+1, sec.title)
+			}
+		}
+		fmt.Fprintf(&b, "    1..%d\n", len(sections))
+	}
+
+	tap.mu.Lock()
+	defer tap.mu.Unlock()
+	tap.n++
+	switch {
+	case err != nil:
+		fmt.Fprintf(&b, "not ok %d - %s\n", tap.n, filename)
+		writeTAPDiag(&b, "  ", err, log.String())
+	case skipped && skip != "":
+		fmt.Fprintf(&b, "ok %d - %s # SKIP %s\n", tap.n, filename, skip)
+	case skipped:
+		fmt.Fprintf(&b, "ok %d - %s # SKIP\n", tap.n, filename)
+	default:
+		fmt.Fprintf(&b, "ok %d - %s\n", tap.n, filename)
+	}
+	tap.write(b.String())
+	return err
+}
+
+// Close writes the plan line reporting the number of scripts that were run,
+// and returns the first error encountered while writing to the underlying
+// io.Writer, if any.
+func (tap *TAP) Close() error {
+	tap.mu.Lock()
+	defer tap.mu.Unlock()
+	tap.write(fmt.Sprintf("1..%d\n", tap.n))
+	return tap.err
+}
+
+// write writes s to tap.w, preceded by the TAP version line if it has not
+// already been written. tap.mu must be held.
+func (tap *TAP) write(s string) {
+	if tap.err != nil {
+		return
+	}
+	if !tap.hdr {
+		tap.hdr = true
+		s = "TAP version 14\n" + s
+	}
+	_, tap.err = io.WriteString(tap.w, s)
+}
+
+// writeTAPDiag writes to b a YAML diagnostic block for err, indented by
+// indent, including log (if non-empty) as a literal block scalar.
+func writeTAPDiag(b *strings.Builder, indent string, err error, log string) {
+	fmt.Fprintf(b, "%s---\n", indent)
+	fmt.Fprintf(b, "%smessage: %s\n", indent, strconv.Quote(err.Error()))
+	if log = strings.TrimRight(log, "\n"); strings.TrimSpace(log) != "" {
+		// The indentation indicator allows the log to begin with a blank or
+		// indented line.
+		fmt.Fprintf(b, "%slog: |2\n", indent)
+		for _, line := range strings.Split(log, "\n") {
+			if line == "" {
+				b.WriteString("\n")
+				continue
+			}
+			fmt.Fprintf(b, "%s  %s\n", indent, line)
+		}
+	}
+	fmt.Fprintf(b, "%s...\n", indent)
+}
+
+// scriptSections returns the sections of script, in order.
+//
+// A section begins with a comment that follows a blank line or a command (or
+// begins the script); the comment lines that directly follow it continue its
+// description rather than beginning sections of their own.
+func scriptSections(script []byte) []section {
+	var sections []section
+	inComment := false
+	for i, line := range strings.Split(string(script), "\n") {
+		if strings.HasPrefix(line, "## NOTE:") {
+			continue
+		}
+		if !strings.HasPrefix(line, "#") {
+			inComment = false
+			continue
+		}
+		if inComment {
+			continue
+		}
+		inComment = true
+		title := strings.TrimSpace(strings.TrimLeft(line, "#"))
+		// '#' begins a directive in a TAP description, so it must be escaped.
+		title = strings.NewReplacer(`\`, `\\`, "#", `\#`).Replace(title)
+		sections = append(sections, section{line: i + 1, title: title})
+	}
+	return sections
+}
@@ -0,0 +1,84 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scripttest
+
+import (
+	"cmd/go/internal/script"
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestTAP(t *testing.T) {
+	scripts := []struct{ name, text string }{
+		{"pass.txt", `# first
+echo a
+
+# second
+# continues the description of the second section
+echo b
+`},
+		{"fail.txt", `# setup
+echo a
+# check
+! echo b
+# never reached
+echo c
+`},
+		{"skip.txt", "skip 'not today'\n"},
+	}
+
+	e := script.NewEngine()
+	e.Cmds["skip"] = Skip()
+	out := new(strings.Builder)
+	tap := NewTAP(out)
+	for _, sc := range scripts {
+		s, err := script.NewState(context.Background(), t.TempDir(), []string{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tap.Run(e, s, sc.name, strings.NewReader(sc.text))
+	}
+	if err := tap.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Section timings vary from run to run.
+	got := regexp.MustCompile(`\(\d+\.\d+s\)`).ReplaceAllString(out.String(), "(0.000s)")
+	const want = `TAP version 14
+# Subtest: pass.txt
+    ok 1 - first
+    ok 2 - second
+    1..2
+ok 1 - pass.txt
+# Subtest: fail.txt
+    ok 1 - setup
+    not ok 2 - check
+      ---
+      message: "fail.txt:4: echo b: unexpected success"
+      ...
+    ok 3 - never reached # SKIP not reached
+    1..3
+not ok 2 - fail.txt
+  ---
+  message: "fail.txt:4: echo b: unexpected success"
+  log: |2
+    # setup (0.000s)
+    > echo a
+    [stdout]
+    a
+    # check (0.000s)
+    > ! echo b
+    [stdout]
+    b
+  ...
+ok 3 - skip.txt # SKIP not today
+1..3
+`
+	if got != want {
+		t.Errorf("TAP output:\n%s\nwant:\n%s", got, want)
+	}
+}
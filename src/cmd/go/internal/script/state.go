@@ -7,6 +7,7 @@ package script
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"internal/txtar"
 	"io"
@@ -15,6 +16,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 )
 
@@ -30,17 +32,39 @@ type State struct {
 
 	workdir string            // initial working directory
 	pwd     string            // current working directory during execution
+	oldpwd  string            // working directory before the last Chdir, for 'cd -'
 	env     []string          // environment list (for os/exec)
 	envMap  map[string]string // environment mapping (matches env)
 	stdout  string            // standard output from last 'go' command; for 'stdout' command
 	stderr  string            // standard error from last 'go' command; for 'stderr' command
 
-	background []backgroundCmd
+	stdin    string // standard input for the next program started by a command; see the 'stdin' command
+	hasStdin bool   // whether stdin is pending
+
+	background []*backgroundCmd          // in the order in which they were started
+	named      map[string]*backgroundCmd // background commands started with -bg=name
+	tempPaths  []string                  // temporary files and directories to remove when the State is closed
+	running    *command                  // the command being run by the engine, if any
+	deferred   []func(*State)            // commands registered by 'defer', in the order in which they were deferred
+
+	archiveFiles map[string]archiveFile // files extracted by ExtractFiles, by absolute path
+	updated      []string               // names of archive files rewritten for Engine.UpdateGolden
+
+	condCache map[condCacheKey]condResult // StateCachedCondition results; cleared when env changes
+	onSetenv  []*setenvHook               // functions registered by OnSetenv
+}
+
+// An archiveFile identifies a file within a txtar archive.
+type archiveFile struct {
+	ar    *txtar.Archive
+	index int
 }
 
 type backgroundCmd struct {
 	*command
-	wait WaitFunc
+	wait   WaitFunc
+	cancel context.CancelFunc // if non-nil, cancels the command's Context
+	killed bool               // the command was stopped by the 'kill' command
 }
 
 // NewState returns a new State permanently associated with ctx, with its
@@ -88,28 +112,44 @@ func NewState(ctx context.Context, workdir string, initialEnv []string) (*State,
 	return s, nil
 }
 
-// CloseAndWait cancels the State's Context and waits for any background commands to
-// finish. If any remaining background command ended in an unexpected state,
-// Close returns a non-nil error.
+// CloseAndWait runs any commands registered by 'defer', then cancels the
+// State's Context and waits for any background commands to finish. If any
+// remaining background command ended in an unexpected state, Close returns a
+// non-nil error.
 func (s *State) CloseAndWait(log io.Writer) error {
+	for len(s.deferred) > 0 {
+		f := s.deferred[len(s.deferred)-1]
+		s.deferred = s.deferred[:len(s.deferred)-1]
+		f(s)
+	}
 	s.cancel()
 	wait, err := Wait().Run(s)
 	if wait != nil {
 		panic("script: internal error: Wait unexpectedly returns its own WaitFunc")
 	}
+	for _, path := range s.tempPaths {
+		if rmErr := removeAll(path); err == nil {
+			err = rmErr
+		}
+	}
+	s.tempPaths = nil
 	if flushErr := s.flushLog(log); err == nil {
 		err = flushErr
 	}
 	return err
 }
 
-// Chdir changes the State's working directory to the given path.
+// Chdir changes the State's working directory to the given path,
+// interpreted as by ResolvePath.
 func (s *State) Chdir(path string) error {
-	dir := s.Path(path)
+	dir, err := s.ResolvePath(path)
+	if err != nil {
+		return err
+	}
 	if _, err := os.Stat(dir); err != nil {
 		return &fs.PathError{Op: "Chdir", Path: dir, Err: err}
 	}
-	s.pwd = dir
+	s.oldpwd, s.pwd = s.pwd, dir
 	s.Setenv("PWD", dir)
 	return nil
 }
@@ -128,8 +168,16 @@ func (s *State) Environ() []string {
 // ExpandEnv replaces ${var} or $var in the string according to the values of
 // the environment variables in s. References to undefined variables are
 // replaced by the empty string.
+//
+// ${var:-word} is replaced by the expansion of word if var is unset or empty,
+// and by the value of var otherwise; ${var:+word} is replaced by the expansion
+// of word if var is set and non-empty, and by the empty string otherwise.
+// $$ is replaced by a single literal $.
+//
+// If inRegexp is true, the values of variables are quoted so that they match
+// literally, but the rest of the string (including any word) is not.
 func (s *State) ExpandEnv(str string, inRegexp bool) string {
-	return os.Expand(str, func(key string) string {
+	lookup := func(key string) string {
 		e := s.envMap[key]
 		if inRegexp {
 			// Quote to literal strings: we want paths like C:\work\go1.4 to remain
@@ -137,7 +185,74 @@ func (s *State) ExpandEnv(str string, inRegexp bool) string {
 			e = regexp.QuoteMeta(e)
 		}
 		return e
-	})
+	}
+
+	var b strings.Builder
+	start := 0 // start of text not yet written to b
+	for i := 0; i < len(str); i++ {
+		if str[i] != '$' {
+			continue
+		}
+		if strings.HasPrefix(str[i:], "$$") {
+			b.WriteString(os.Expand(str[start:i], lookup))
+			b.WriteByte('$')
+			i++
+			start = i + 1
+			continue
+		}
+		name, op, word, n := parseParamExpansion(str[i:])
+		if n == 0 {
+			continue
+		}
+		b.WriteString(os.Expand(str[start:i], lookup))
+		v, ok := s.envMap[name]
+		switch {
+		case op == '-' && (!ok || v == ""), op == '+' && ok && v != "":
+			b.WriteString(s.ExpandEnv(word, inRegexp))
+		case op == '-':
+			b.WriteString(lookup(name))
+		}
+		i += n - 1
+		start = i + 1
+	}
+	if start == 0 {
+		return os.Expand(str, lookup)
+	}
+	b.WriteString(os.Expand(str[start:], lookup))
+	return b.String()
+}
+
+// parseParamExpansion reports whether str begins with an expansion of the
+// form ${name:-word} or ${name:+word}, in which word may contain balanced
+// references of the form ${...}. If so, it returns the name, the operator
+// ('-' or '+'), the text of word, and the length of the expansion.
+// Otherwise, it returns n == 0.
+func parseParamExpansion(str string) (name string, op byte, word string, n int) {
+	if !strings.HasPrefix(str, "${") {
+		return "", 0, "", 0
+	}
+	i := 2
+	for i < len(str) && (str[i] == '_' || '0' <= str[i] && str[i] <= '9' || 'a' <= str[i] && str[i] <= 'z' || 'A' <= str[i] && str[i] <= 'Z') {
+		i++
+	}
+	if i == 2 || i+1 >= len(str) || str[i] != ':' || (str[i+1] != '-' && str[i+1] != '+') {
+		return "", 0, "", 0
+	}
+	name, op = str[2:i], str[i+1]
+	depth := 0
+	for j := i + 2; j < len(str); j++ {
+		switch {
+		case strings.HasPrefix(str[j:], "${"):
+			depth++
+			j++
+		case str[j] == '}':
+			if depth == 0 {
+				return name, op, str[i+2 : j], j + 1
+			}
+			depth--
+		}
+	}
+	return "", 0, "", 0
 }
 
 // ExtractFiles extracts the files in ar to the state's current directory,
@@ -158,7 +273,7 @@ func (s *State) ExtractFiles(ar *txtar.Archive) error {
 		wd += string(filepath.Separator)
 	}
 
-	for _, f := range ar.Files {
+	for i, f := range ar.Files {
 		name := s.Path(s.ExpandEnv(f.Name, false))
 
 		if !strings.HasPrefix(name, wd) {
@@ -171,8 +286,80 @@ func (s *State) ExtractFiles(ar *txtar.Archive) error {
 		if err := os.WriteFile(name, f.Data, 0666); err != nil {
 			return err
 		}
+		if s.archiveFiles == nil {
+			s.archiveFiles = make(map[string]archiveFile)
+		}
+		s.archiveFiles[name] = archiveFile{ar: ar, index: i}
+	}
+
+	return nil
+}
+
+// UpdatedFiles returns the names of the archive files whose contents were
+// rewritten because the State was run by an Engine with UpdateGolden set,
+// in the order in which they were first updated.
+//
+// The caller is responsible for writing the modified archives back to their
+// source, if desired.
+func (s *State) UpdatedFiles() []string {
+	return append([]string(nil), s.updated...)
+}
+
+// updateArchiveFile replaces the contents of the file at path with data,
+// and reports whether path was extracted from an archive by ExtractFiles.
+// If it was not, updateArchiveFile does nothing.
+func (s *State) updateArchiveFile(path string, data []byte) (bool, error) {
+	af, ok := s.archiveFiles[path]
+	if !ok {
+		return false, nil
+	}
+	if err := os.WriteFile(path, data, 0666); err != nil {
+		return false, err
+	}
+	f := &af.ar.Files[af.index]
+	f.Data = append([]byte(nil), data...)
+	for _, name := range s.updated {
+		if name == f.Name {
+			return true, nil
+		}
+	}
+	s.updated = append(s.updated, f.Name)
+	return true, nil
+}
+
+// copyForWait returns a shallow copy of s with an empty log, for use by a
+// WaitFunc that may run concurrently with others.
+func (s *State) copyForWait() *State {
+	c := &State{}
+	*c = *s
+	c.log = bytes.Buffer{}
+	c.condCache = nil
+	c.onSetenv = nil // changes are reported when they are merged back into s
+	c.env = append([]string(nil), s.env...)
+	c.envMap = make(map[string]string, len(s.envMap))
+	for k, v := range s.envMap {
+		c.envMap[k] = v
 	}
+	return c
+}
 
+// mergeEnv applies to s the differences between the environment variables in
+// env and those in the earlier environment before.
+func (s *State) mergeEnv(env, before map[string]string) error {
+	for k, v := range env {
+		if old, ok := before[k]; !ok || old != v {
+			if err := s.Setenv(k, v); err != nil {
+				return err
+			}
+		}
+	}
+	for k := range before {
+		if _, ok := env[k]; !ok {
+			if err := s.Unsetenv(k); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
@@ -207,21 +394,374 @@ func (s *State) Path(path string) string {
 	return filepath.Join(s.pwd, path)
 }
 
+// ResolvePath is like Path, but if the State is being executed by an Engine
+// with Sandbox set, it returns an error if the path, after evaluating any
+// symlinks, is not within the State's initial working directory.
+//
+// Commands that access files should resolve their arguments with ResolvePath
+// (or use ReadFile, Stat, or WriteFile, which do so) to respect the sandbox.
+// A returned error is an *fs.PathError reporting the path as returned by Path.
+func (s *State) ResolvePath(path string) (string, error) {
+	p := s.Path(path)
+	return p, s.checkSandbox(p, true)
+}
+
+// resolveLink is like ResolvePath, but does not follow a symlink in the final
+// element of path, for commands such as 'rm' and 'mv' that act on the link
+// itself.
+func (s *State) resolveLink(path string) (string, error) {
+	p := s.Path(path)
+	return p, s.checkSandbox(p, false)
+}
+
+// checkWrite is the check passed to copyTree by commands that copy into the
+// work directory: it rejects each destination path that the sandbox does not
+// allow, following symlinks as the copy would when writing.
+func (s *State) checkWrite(p string) error {
+	return s.checkSandbox(p, true)
+}
+
+// errOutsideSandbox is reported for paths rejected by Engine.Sandbox.
+var errOutsideSandbox = errors.New("path is outside the sandbox")
+
+// checkSandbox returns an error if s is being executed by an Engine with
+// Sandbox set and the absolute path p, after evaluating symlinks (except in
+// its final element, unless follow is true), is not within s.workdir.
+func (s *State) checkSandbox(p string, follow bool) error {
+	if s.engine == nil || !s.engine.Sandbox {
+		return nil
+	}
+	root, err := filepath.EvalSymlinks(s.workdir)
+	if err != nil {
+		return err
+	}
+
+	resolved := p
+	if !follow && filepath.Dir(p) != p {
+		dir, err := evalExistingSymlinks(filepath.Dir(p))
+		if err != nil {
+			return &fs.PathError{Op: "sandbox", Path: p, Err: err}
+		}
+		resolved = filepath.Join(dir, filepath.Base(p))
+	} else {
+		resolved, err = evalExistingSymlinks(p)
+		if err != nil {
+			return &fs.PathError{Op: "sandbox", Path: p, Err: err}
+		}
+	}
+
+	if rel, err := filepath.Rel(root, resolved); err != nil || (rel != "." && !filepath.IsLocal(rel)) {
+		return &fs.PathError{Op: "sandbox", Path: p, Err: errOutsideSandbox}
+	}
+	return nil
+}
+
+// evalExistingSymlinks is like filepath.EvalSymlinks, but allows the trailing
+// elements of the absolute path p not to exist yet.
+func evalExistingSymlinks(p string) (string, error) {
+	rest := ""
+	for {
+		resolved, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			return filepath.Join(resolved, rest), nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		if _, lerr := os.Lstat(p); lerr == nil {
+			// p is a symlink whose target does not exist, so it is
+			// impossible to tell where a file created through it would go.
+			return "", fmt.Errorf("cannot resolve symlink %s: %w", p, err)
+		}
+		dir := filepath.Dir(p)
+		if dir == p {
+			return "", err
+		}
+		rest = filepath.Join(filepath.Base(p), rest)
+		p = dir
+	}
+}
+
+// ReadFile reads the file at the script-based path name, interpreted as by
+// ResolvePath, and returns its contents. A returned error is an *fs.PathError
+// reporting the resolved path.
+func (s *State) ReadFile(name string) ([]byte, error) {
+	p, err := s.ResolvePath(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(p)
+}
+
 // Setenv sets the value of the environment variable in s named by the key.
 func (s *State) Setenv(key, value string) error {
 	s.env = cleanEnv(append(s.env, key+"="+value), s.pwd)
 	s.envMap[key] = value
+	s.condCache = nil
+	s.notifySetenv(key, value)
+	return nil
+}
+
+// Unsetenv removes the environment variable in s named by the key.
+// Removing a variable that is not set is a no-op.
+func (s *State) Unsetenv(key string) error {
+	env := s.env[:0:0]
+	for _, kv := range s.env {
+		if k, _, ok := strings.Cut(kv, "="); ok && k == key {
+			continue
+		}
+		env = append(env, kv)
+	}
+	s.env = env
+	delete(s.envMap, key)
+	s.condCache = nil
+	s.notifySetenv(key, "")
 	return nil
 }
 
+// OnSetenv registers f to be called whenever a variable in the environment of
+// s is set or removed, so that a condition or command that caches values
+// derived from the environment can invalidate them.
+//
+// f is called with the variable's new value, or the empty string if it was
+// removed. Calls happen synchronously on the goroutine that changed the
+// environment, after the change has been made (so that s.LookupEnv reports the
+// new value) and before the method that made it returns. If several functions
+// are registered, they are called in the order in which they were registered.
+// Calling the returned function unregisters f; registering the same function
+// twice causes it to be called twice until each registration is removed.
+//
+// Changes made by the WaitFunc of a background command are reported when
+// they are applied to s by the 'wait' command, not while the command runs.
+// Changes made by Restore are reported one variable at a time, in sorted
+// order by key. The initial environment passed to NewState is not reported.
+func (s *State) OnSetenv(f func(key, value string)) (remove func()) {
+	h := &setenvHook{f: f}
+	s.onSetenv = append(s.onSetenv, h)
+	return func() {
+		for i, g := range s.onSetenv {
+			if g == h {
+				// Copy rather than shift in place, in case the hooks are being
+				// called right now.
+				s.onSetenv = append(s.onSetenv[:i:i], s.onSetenv[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// A setenvHook is a function registered by OnSetenv.
+// Each registration has its own hook, so that it can be removed.
+type setenvHook struct {
+	f func(key, value string)
+}
+
+// notifySetenv calls the functions registered by OnSetenv.
+func (s *State) notifySetenv(key, value string) {
+	for _, h := range s.onSetenv {
+		h.f(key, value)
+	}
+}
+
+// A StateSnapshot records the contents of a State's working directory and its
+// environment at a point in time, for later use by [State.Restore].
+type StateSnapshot struct {
+	dir    string // copy of the State's initial working directory
+	pwd    string
+	env    []string
+	envMap map[string]string
+}
+
+// Snapshot records the contents of the directory tree rooted at the State's
+// initial working directory, along with the current directory and environment.
+//
+// The files are copied rather than hard-linked, because commands such as
+// 'cp' and 'replace' modify existing files in place. Symlinks are recreated
+// as symlinks, and file and directory modes are preserved.
+//
+// The copy is removed when the State is closed.
+func (s *State) Snapshot() (*StateSnapshot, error) {
+	dir, err := os.MkdirTemp("", "script-snapshot-")
+	if err != nil {
+		return nil, err
+	}
+	if err := copyTree(dir, s.workdir, false, nil); err != nil {
+		removeAll(dir)
+		return nil, err
+	}
+
+	envMap := make(map[string]string, len(s.envMap))
+	for k, v := range s.envMap {
+		envMap[k] = v
+	}
+	snap := &StateSnapshot{
+		dir:    dir,
+		pwd:    s.pwd,
+		env:    append([]string(nil), s.env...),
+		envMap: envMap,
+	}
+	s.tempPaths = append(s.tempPaths, dir)
+	return snap, nil
+}
+
+// Restore replaces the contents of the State's initial working directory
+// with the files recorded in snap, and resets the current directory and
+// environment to their values at the time of the snapshot.
+//
+// The same snapshot may be restored any number of times.
+func (s *State) Restore(snap *StateSnapshot) error {
+	ents, err := os.ReadDir(s.workdir)
+	if err != nil {
+		return err
+	}
+	for _, ent := range ents {
+		if err := removeAll(filepath.Join(s.workdir, ent.Name())); err != nil {
+			return err
+		}
+	}
+	if err := copyTree(s.workdir, snap.dir, false, nil); err != nil {
+		return err
+	}
+
+	var changed []string
+	for k, v := range snap.envMap {
+		if old, ok := s.envMap[k]; !ok || old != v {
+			changed = append(changed, k)
+		}
+	}
+	for k := range s.envMap {
+		if _, ok := snap.envMap[k]; !ok {
+			changed = append(changed, k)
+		}
+	}
+	sort.Strings(changed)
+
+	s.pwd = snap.pwd
+	s.env = append([]string(nil), snap.env...)
+	s.envMap = make(map[string]string, len(snap.envMap))
+	for k, v := range snap.envMap {
+		s.envMap[k] = v
+	}
+	s.condCache = nil
+	for _, k := range changed {
+		s.notifySetenv(k, s.envMap[k])
+	}
+	return nil
+}
+
+// copyTree copies the contents of the directory src into the existing
+// directory dst, preserving modes. Symlinks are recreated as symlinks unless
+// followLinks is true, in which case their targets are copied instead.
+// If check is non-nil, it is called with each destination path before that
+// path is written, and an error from it stops the copy.
+func copyTree(dst, src string, followLinks bool, check func(string) error) error {
+	ents, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, ent := range ents {
+		if err := copyEntry(filepath.Join(dst, ent.Name()), filepath.Join(src, ent.Name()), followLinks, check); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// within reports whether the absolute path p is dir or is inside of it.
+func within(p, dir string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && (rel == "." || filepath.IsLocal(rel))
+}
+
+// copyEntry copies the file, directory tree, or symlink src to dst, as for
+// copyTree. If src is a directory and dst is an existing directory, the
+// contents of src are merged into dst.
+func copyEntry(dst, src string, followLinks bool, check func(string) error) error {
+	if check != nil {
+		if err := check(dst); err != nil {
+			return err
+		}
+	}
+	stat := os.Lstat
+	if followLinks {
+		stat = os.Stat
+	}
+	info, err := stat(src)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case info.IsDir():
+		if err := os.Mkdir(dst, 0777); err != nil {
+			if dstInfo, statErr := os.Stat(dst); statErr != nil || !dstInfo.IsDir() {
+				return err
+			}
+		}
+		if err := copyTree(dst, src, followLinks, check); err != nil {
+			return err
+		}
+		// Apply the directory's mode only after its contents are written,
+		// in case it is read-only.
+		return os.Chmod(dst, info.Mode().Perm())
+
+	case info.Mode()&fs.ModeSymlink != 0:
+		link, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(link, dst)
+
+	default:
+		data, err := os.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(dst, data, 0666); err != nil {
+			return err
+		}
+		return os.Chmod(dst, info.Mode().Perm())
+	}
+}
+
 // Stdout returns the stdout output of the last command run,
 // or the empty string if no command has been run.
+//
+// The buffer is replaced by the output of each command that returns a
+// WaitFunc and is cleared when a command is started in the background.
+// Commands that return no WaitFunc, such as the 'stdout' command itself, leave
+// it unchanged, so a Cmd or Cond may call Stdout to inspect the output of the
+// command that preceded it.
 func (s *State) Stdout() string { return s.stdout }
 
 // Stderr returns the stderr output of the last command run,
 // or the empty string if no command has been run.
+// It is updated at the same times as Stdout.
 func (s *State) Stderr() string { return s.stderr }
 
+// Stat returns the FileInfo for the file at the script-based path name,
+// interpreted as by ResolvePath. Like os.Stat, it follows symlinks. A returned
+// error is an *fs.PathError reporting the resolved path.
+func (s *State) Stat(name string) (fs.FileInfo, error) {
+	p, err := s.ResolvePath(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(p)
+}
+
+// WriteFile writes data to the file at the script-based path name,
+// interpreted as by ResolvePath, creating it with permissions perm (before
+// umask) if necessary and truncating it otherwise. A returned error is an
+// *fs.PathError reporting the resolved path.
+func (s *State) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	p, err := s.ResolvePath(name)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p, data, perm)
+}
+
 // cleanEnv returns a copy of env with any duplicates removed in favor of
 // later values and any required system variables defined.
 //
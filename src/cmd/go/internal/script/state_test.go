@@ -0,0 +1,292 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package script
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewState(context.Background(), dir, []string{"A=a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.CloseAndWait(new(strings.Builder))
+
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sub", "b.txt"), []byte("b"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(dir, "a.txt"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := s.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		// Change the environment, the working directory, and the files.
+		s.Setenv("X", "x")
+		s.Unsetenv("A")
+		if err := s.Chdir("sub"); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("changed"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(filepath.Join(dir, "a.txt"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "sub", "new.txt"), nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(filepath.Join(dir, "sub", "b.txt")); err != nil {
+			t.Fatal(err)
+		}
+
+		// The same snapshot may be restored repeatedly.
+		if err := s.Restore(snap); err != nil {
+			t.Fatal(err)
+		}
+		if v, ok := s.LookupEnv("A"); v != "a" || !ok {
+			t.Errorf("after Restore, A = %q, %v; want a", v, ok)
+		}
+		if v, ok := s.LookupEnv("X"); ok {
+			t.Errorf("after Restore, X = %q; want unset", v)
+		}
+		if wd := s.Getwd(); wd != dir {
+			t.Errorf("after Restore, Getwd() = %q; want %q", wd, dir)
+		}
+		if data, err := os.ReadFile(filepath.Join(dir, "a.txt")); err != nil || string(data) != "a" {
+			t.Errorf("after Restore, a.txt = %q, %v; want a", data, err)
+		}
+		if info, err := os.Stat(filepath.Join(dir, "a.txt")); err != nil {
+			t.Error(err)
+		} else if runtime.GOOS != "windows" && info.Mode().Perm() != 0755 {
+			t.Errorf("after Restore, a.txt has mode %v; want %v", info.Mode().Perm(), fs.FileMode(0755))
+		}
+		if _, err := os.Stat(filepath.Join(dir, "sub", "new.txt")); err == nil {
+			t.Errorf("after Restore, file created after Snapshot still exists")
+		}
+		if data, err := os.ReadFile(filepath.Join(dir, "sub", "b.txt")); err != nil || string(data) != "b" {
+			t.Errorf("after Restore, sub/b.txt = %q, %v; want b", data, err)
+		}
+	}
+}
+
+func TestStateFiles(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewState(context.Background(), dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Chdir("sub"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Relative paths are resolved against the script's working directory,
+	// not the process's.
+	if err := s.WriteFile("f.txt", []byte("hello"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "sub", "f.txt")); err != nil || string(data) != "hello" {
+		t.Errorf("WriteFile(f.txt) wrote %q, %v to sub/f.txt; want %q", data, err, "hello")
+	}
+	if data, err := s.ReadFile("f.txt"); err != nil || string(data) != "hello" {
+		t.Errorf("ReadFile(f.txt) = %q, %v; want %q", data, err, "hello")
+	}
+	if data, err := s.ReadFile(filepath.Join(dir, "sub", "f.txt")); err != nil || string(data) != "hello" {
+		t.Errorf("ReadFile of absolute path = %q, %v; want %q", data, err, "hello")
+	}
+	if info, err := s.Stat("../sub/f.txt"); err != nil || info.Size() != 5 {
+		t.Errorf("Stat(../sub/f.txt) = %v, %v; want a 5-byte file", info, err)
+	}
+
+	// Errors are *fs.PathErrors reporting the resolved path.
+	missing := filepath.Join(dir, "sub", "missing.txt")
+	checkErr := func(op string, err error, path string) {
+		t.Helper()
+		var pe *fs.PathError
+		if !errors.As(err, &pe) {
+			t.Errorf("%s: error %v is not an *fs.PathError", op, err)
+		} else if pe.Path != path {
+			t.Errorf("%s: error reports path %q; want %q", op, pe.Path, path)
+		}
+	}
+	_, err = s.ReadFile("missing.txt")
+	checkErr("ReadFile", err, missing)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("ReadFile(missing.txt): %v; want fs.ErrNotExist", err)
+	}
+	_, err = s.Stat("missing.txt")
+	checkErr("Stat", err, missing)
+	err = s.WriteFile("nodir/f.txt", nil, 0666)
+	checkErr("WriteFile", err, filepath.Join(dir, "sub", "nodir", "f.txt"))
+}
+
+func TestExpandEnv(t *testing.T) {
+	s, err := NewState(context.Background(), t.TempDir(), []string{
+		"A=a",
+		"B=b",
+		"EMPTY=",
+		"DOT=x.y",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		in       string
+		inRegexp bool
+		want     string
+	}{
+		// Plain references are unchanged.
+		{in: "$A", want: "a"},
+		{in: "${A}", want: "a"},
+		{in: "$A$B", want: "ab"},
+		{in: "x${A}y", want: "xay"},
+		{in: "$UNSET", want: ""},
+		{in: "${}", want: ""},
+		{in: "${A", want: "A"},
+		{in: "$", want: "$"},
+		{in: "a$", want: "a$"},
+		{in: "$.", want: "$."},
+		{in: "${A:}", want: ""},
+
+		// ${var:-word}
+		{in: "${A:-def}", want: "a"},
+		{in: "${UNSET:-def}", want: "def"},
+		{in: "${EMPTY:-def}", want: "def"},
+		{in: "${UNSET:-}", want: ""},
+		{in: "${UNSET:-$B}", want: "b"},
+		{in: "${UNSET:-${B}}", want: "b"},
+		{in: "${UNSET:-${EMPTY:-${B}x}}", want: "bx"},
+		{in: "${UNSET:-${A:+alt}}", want: "alt"},
+		{in: "pre${UNSET:-mid}post$A", want: "premidposta"},
+		{in: "${UNSET:-a:b}", want: "a:b"},
+		{in: "${UNSET:-def", want: "UNSET:-def"},
+
+		// ${var:+word}
+		{in: "${A:+alt}", want: "alt"},
+		{in: "${UNSET:+alt}", want: ""},
+		{in: "${EMPTY:+alt}", want: ""},
+		{in: "${A:+$B-$A}", want: "b-a"},
+
+		// $$ is a literal $.
+		{in: "$$", want: "$"},
+		{in: "$$A", want: "$A"},
+		{in: "$${A}", want: "${A}"},
+		{in: "$$$A", want: "$a"},
+		{in: "$A$$", want: "a$"},
+		{in: "${UNSET:-$$}", want: "$"},
+		{in: "${UNSET:-$${A}}", want: "${A}"},
+
+		// Only the values of variables are quoted in regexps.
+		{in: "$DOT", inRegexp: true, want: `x\.y`},
+		{in: "${UNSET:-a.b}", inRegexp: true, want: "a.b"},
+		{in: "${UNSET:-$DOT}", inRegexp: true, want: `x\.y`},
+		{in: "${DOT:-a.b}", inRegexp: true, want: `x\.y`},
+	} {
+		if got := s.ExpandEnv(tt.in, tt.inRegexp); got != tt.want {
+			t.Errorf("ExpandEnv(%#q, %v) = %#q; want %#q", tt.in, tt.inRegexp, got, tt.want)
+		}
+	}
+}
+
+func TestOnSetenv(t *testing.T) {
+	s, err := NewState(context.Background(), t.TempDir(), []string{"A=a", "B=b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.CloseAndWait(new(strings.Builder))
+
+	snap, err := s.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	s.OnSetenv(func(key, value string) {
+		// The change is visible by the time f is called.
+		v, _ := s.LookupEnv(key)
+		got = append(got, fmt.Sprintf("1:%s=%s(%s)", key, value, v))
+	})
+	s.OnSetenv(func(key, value string) {
+		got = append(got, fmt.Sprintf("2:%s=%s", key, value))
+	})
+
+	s.Setenv("A", "x")
+	s.Unsetenv("B")
+	s.Setenv("C", "c")
+	if err := s.Restore(snap); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"1:A=x(x)", "2:A=x",
+		"1:B=()", "2:B=",
+		"1:C=c(c)", "2:C=c",
+		// Restore reports each changed variable in sorted order.
+		"1:A=a(a)", "2:A=a",
+		"1:B=b(b)", "2:B=b",
+		"1:C=()", "2:C=",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("OnSetenv calls:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestOnSetenvRemove(t *testing.T) {
+	s, err := NewState(context.Background(), t.TempDir(), []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.CloseAndWait(new(strings.Builder))
+
+	var got []string
+	hook := func(name string) func(key, value string) {
+		return func(key, value string) { got = append(got, name+":"+key) }
+	}
+	var removeSelf func()
+	removeSelf = s.OnSetenv(func(key, value string) {
+		got = append(got, "self:"+key)
+		removeSelf()
+	})
+	removeA := s.OnSetenv(hook("a"))
+	removeB1 := s.OnSetenv(hook("b"))
+	s.OnSetenv(hook("b"))
+
+	s.Setenv("X", "1")
+	removeA()
+	removeB1()
+	removeB1() // Removing a hook again has no effect.
+	s.Setenv("Y", "1")
+
+	// A hook that removes itself while being called does not keep the others
+	// from being called, and is not called again. Each registration of the
+	// same hook is removed separately.
+	want := []string{"self:X", "a:X", "b:X", "b:X", "b:Y"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("OnSetenv calls: %q; want %q", got, want)
+	}
+}
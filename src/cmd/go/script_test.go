@@ -34,6 +34,7 @@ import (
 )
 
 var testSum = flag.String("testsum", "", `may be tidy, listm, or listall. If set, TestScript generates a go.sum file at the beginning of each test and updates test files if they pass.`)
+var testUpdate = flag.Bool("update", false, "if true, TestScript rewrites the expected files of failing cmp commands within test files")
 
 // TestScript runs the tests in testdata/script/*.txt.
 func TestScript(t *testing.T) {
@@ -91,6 +92,11 @@ func TestScript(t *testing.T) {
 		Conds: scriptConditions(),
 		Cmds:  scriptCommands(quitSignal(), gracePeriod),
 		Quiet: !testing.Verbose(),
+
+		MaxDiffLines:   script.DefaultMaxDiffLines,
+		MaxOutputBytes: script.DefaultMaxOutputBytes,
+
+		UpdateGolden: *testUpdate,
 	}
 
 	t.Run("README", func(t *testing.T) {
@@ -152,6 +158,15 @@ func TestScript(t *testing.T) {
 			}
 
 			scripttest.Run(t, engine, s, filepath.Base(file), bytes.NewReader(a.Comment))
+
+			// With -update, write back any expected files that were rewritten
+			// by cmp, provided that nothing else failed.
+			if updated := s.UpdatedFiles(); len(updated) > 0 && !t.Failed() {
+				t.Logf("updating %s in %s", strings.Join(updated, ", "), file)
+				if err := os.WriteFile(file, txtar.Format(a), 0666); err != nil {
+					t.Errorf("rewriting test file: %v", err)
+				}
+			}
 		})
 	}
 }
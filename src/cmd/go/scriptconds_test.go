@@ -13,12 +13,14 @@ import (
 	"internal/buildcfg"
 	"internal/platform"
 	"internal/testenv"
-	"os"
+	"net"
 	"os/exec"
 	"path/filepath"
 	"runtime"
 	"runtime/debug"
 	"strings"
+	"sync"
+	"time"
 )
 
 func scriptConditions() map[string]script.Cond {
@@ -37,22 +39,24 @@ func scriptConditions() map[string]script.Cond {
 
 	add("abscc", script.Condition("default $CC path is absolute and exists", defaultCCIsAbsolute))
 	add("asan", sysCondition("-asan", platform.ASanSupported, true))
-	add("buildmode", script.PrefixCondition("go supports -buildmode=<suffix>", hasBuildmode))
-	add("case-sensitive", script.OnceCondition("$WORK filesystem is case-sensitive", isCaseSensitive))
+	add("asan-instrumented", script.OnceCondition("test binary was built with -asan", builtWith("-asan")))
+	add("buildmode", script.StateCachedCondition("go supports -buildmode=<suffix>", hasBuildmode))
 	add("cgo", script.BoolCondition("host CGO_ENABLED", testenv.HasCGO()))
 	add("cross", script.BoolCondition("cmd/go GOOS/GOARCH != GOHOSTOS/GOHOSTARCH", goHostOS != runtime.GOOS || goHostArch != runtime.GOARCH))
 	add("fuzz", sysCondition("-fuzz", platform.FuzzSupported, false))
 	add("fuzz-instrumented", sysCondition("-fuzz with instrumentation", platform.FuzzInstrumented, false))
+	add("gcflag", script.CachedCondition("'go tool compile -help' lists the flag <suffix>", hasCompileFlag))
 	add("git", lazyBool("the 'git' executable exists and provides the standard CLI", hasWorkingGit))
 	add("GODEBUG", script.PrefixCondition("GODEBUG contains <suffix>", hasGodebug))
-	add("GOEXPERIMENT", script.PrefixCondition("GOEXPERIMENT <suffix> is enabled", hasGoexperiment))
+	add("GOEXPERIMENT", script.StateCachedCondition("GOEXPERIMENT <suffix> is enabled", hasGoexperiment))
 	add("link", lazyBool("testenv.HasLink()", testenv.HasLink))
 	add("mismatched-goroot", script.Condition("test's GOROOT_FINAL does not match the real GOROOT", isMismatchedGoroot))
 	add("msan", sysCondition("-msan", platform.MSanSupported, true))
-	add("net", lazyBool("testenv.HasExternalNetwork()", testenv.HasExternalNetwork))
+	add("msan-instrumented", script.OnceCondition("test binary was built with -msan", builtWith("-msan")))
+	add("net", netCond())
 	add("race", sysCondition("-race", platform.RaceDetectorSupported, true))
-	add("symlink", lazyBool("testenv.HasSymlink()", testenv.HasSymlink))
-	add("trimpath", script.OnceCondition("test binary was built with -trimpath", isTrimpath))
+	add("race-instrumented", script.OnceCondition("test binary was built with -race", builtWith("-race")))
+	add("trimpath", script.OnceCondition("test binary was built with -trimpath", builtWith("-trimpath")))
 
 	return conds
 }
@@ -123,38 +127,130 @@ func hasGoexperiment(s *script.State, value string) (bool, error) {
 	return false, fmt.Errorf("unrecognized GOEXPERIMENT %q", value)
 }
 
-func isCaseSensitive() (bool, error) {
-	tmpdir, err := os.MkdirTemp(testTmpDir, "case-sensitive")
-	if err != nil {
-		return false, fmt.Errorf("failed to create directory to determine case-sensitivity: %w", err)
+// builtWith returns a function that reports whether the test binary was built
+// with the given boolean build flag, such as "-trimpath" or "-race".
+func builtWith(flag string) func() (bool, error) {
+	return func() (bool, error) {
+		info, _ := debug.ReadBuildInfo()
+		if info == nil {
+			return false, errors.New("missing build info")
+		}
+
+		for _, s := range info.Settings {
+			if s.Key == flag && s.Value == "true" {
+				return true, nil
+			}
+		}
+		return false, nil
 	}
-	defer os.RemoveAll(tmpdir)
+}
 
-	fcap := filepath.Join(tmpdir, "FILE")
-	if err := os.WriteFile(fcap, []byte{}, 0644); err != nil {
-		return false, fmt.Errorf("error writing file to determine case-sensitivity: %w", err)
+// netCond returns a condition that reports whether the test is allowed to use
+// the external network or, given a host:port suffix, whether a TCP connection
+// to that address succeeds.
+//
+// The suffix is expanded before use. Addresses other than loopback ones are
+// only dialed if testenv.HasExternalNetwork reports true. Results are cached
+// per address for the lifetime of the script.
+func netCond() script.Cond {
+	return &netReachableCond{
+		usage: script.CondUsage{
+			Summary:        "testenv.HasExternalNetwork(), or a TCP connection to <suffix> (host:port, after environment expansion) succeeds",
+			Prefix:         true,
+			OptionalSuffix: true,
+		},
+		dial: script.StateCachedCondition("", canDial),
 	}
+}
+
+type netReachableCond struct {
+	usage script.CondUsage
+	dial  script.Cond
+}
 
-	flow := filepath.Join(tmpdir, "file")
-	_, err = os.ReadFile(flow)
-	switch {
-	case err == nil:
+func (c *netReachableCond) Usage() *script.CondUsage { return &c.usage }
+
+func (c *netReachableCond) Eval(s *script.State, suffix string) (bool, error) {
+	if suffix == "" {
+		return testenv.HasExternalNetwork(), nil
+	}
+	return c.dial.Eval(s, s.ExpandEnv(suffix, false))
+}
+
+// netDialTimeout bounds the time spent checking whether an address is reachable.
+const netDialTimeout = 5 * time.Second
+
+func canDial(s *script.State, addr string) (bool, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false, err
+	}
+	if !isLoopbackHost(host) && !testenv.HasExternalNetwork() {
 		return false, nil
-	case os.IsNotExist(err):
-		return true, nil
-	default:
-		return false, fmt.Errorf("unexpected error reading file when determining case-sensitivity: %w", err)
 	}
+
+	d := net.Dialer{Timeout: netDialTimeout}
+	conn, err := d.DialContext(s.Context(), "tcp", addr)
+	if err != nil {
+		if ctxErr := s.Context().Err(); ctxErr != nil {
+			return false, ctxErr
+		}
+		return false, nil
+	}
+	conn.Close()
+	return true, nil
+}
+
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
 }
 
-func isTrimpath() (bool, error) {
-	info, _ := debug.ReadBuildInfo()
-	if info == nil {
-		return false, errors.New("missing build info")
+var compileHelp struct {
+	once sync.Once
+	text string
+	err  error
+}
+
+// hasCompileFlag reports whether the compiler's usage message lists the named
+// flag, with or without its leading dash.
+func hasCompileFlag(flag string) (bool, error) {
+	flag = strings.TrimPrefix(flag, "-")
+	if flag == "" {
+		return false, errors.New("missing flag name")
+	}
+
+	compileHelp.once.Do(func() {
+		goTool, err := testenv.GoTool()
+		if err != nil {
+			compileHelp.err = err
+			return
+		}
+		// 'go tool compile -help' prints its usage and exits with a non-zero
+		// status, so check for the usage message instead.
+		out, err := exec.Command(goTool, "tool", "compile", "-help").CombinedOutput()
+		if !strings.Contains(string(out), "usage: compile") {
+			compileHelp.err = fmt.Errorf("go tool compile -help: %v\n%s", err, out)
+			return
+		}
+		compileHelp.text = string(out)
+	})
+	if compileHelp.err != nil {
+		return false, compileHelp.err
 	}
 
-	for _, s := range info.Settings {
-		if s.Key == "-trimpath" && s.Value == "true" {
+	for _, line := range strings.Split(compileHelp.text, "\n") {
+		name, ok := strings.CutPrefix(strings.TrimSpace(line), "-")
+		if !ok {
+			continue
+		}
+		if i := strings.IndexAny(name, " \t"); i >= 0 {
+			name = name[:i]
+		}
+		if name == flag {
 			return true, nil
 		}
 	}
@@ -52,10 +52,18 @@ func checkScriptReadme(t *testing.T, engine *script.Engine, env []string) {
 	if !ok {
 		t.Fatalf("%q did not include Script Language section", cmd)
 	}
-	lang, _, ok = strings.Cut(lang, "\n\nvar ")
-	if !ok {
-		t.Fatalf("%q did not include vars after Script Language section", cmd)
+	// The package documentation is followed by its declarations,
+	// starting with either consts or vars.
+	end := -1
+	for _, decl := range []string{"\n\nconst ", "\n\nvar "} {
+		if i := strings.Index(lang, decl); i >= 0 && (end < 0 || i < end) {
+			end = i
+		}
+	}
+	if end < 0 {
+		t.Fatalf("%q did not include consts or vars after Script Language section", cmd)
 	}
+	lang = lang[:end]
 	args.Language = lang
 
 	tmpl := template.Must(template.New("README").Parse(readmeTmpl[1:]))